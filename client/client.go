@@ -17,22 +17,44 @@ import (
 )
 
 const (
-	MTU = 1300
+	DefaultMTU = 1300  // Tunnel MTU when none is configured
+	MinMTU     = 576   // Smallest datagram every IPv4 host must accept
+	MaxMTU     = 65535 // Largest packet an IPv4 header can describe
 )
 
 // Info that the client sends in its first packet after connection
 // encoded as json
 type ClientInfo struct {
-	Time    string `json:"time"`
-	Version string `json:"version"`
+	Time    string   `json:"time"`
+	Version string   `json:"version"`
+	Session string   `json:"session,omitempty"` // set by striped connections joining an existing session
+	MTU     int      `json:"mtu,omitempty"`     // the largest tunnel MTU the client supports
+	Subnets []string `json:"subnets,omitempty"` // subnets behind the client that it offers to serve as a gateway for
 }
 
 // Settings to send json encoded as the first packet to the client after reading
 // its first packet which contains ClientInfo
 type ClientSettings struct {
-	Time    string `json:"time"`
-	Version string `json:"version"`
-	IP      string `json:"ip"`
+	Time    string   `json:"time"`
+	Version string   `json:"version"`
+	IP      string   `json:"ip"`
+	Session string   `json:"session"`           // token for joining further striped connections to this session
+	MTU     int      `json:"mtu"`               // the negotiated tunnel MTU
+	Subnets []string `json:"subnets,omitempty"` // subnets the client serves as a gateway for
+	IP6     string   `json:"ip6,omitempty"`     // the client's tunnel IPv6 address and prefix length, when the tunnel is dual-stack
+	Prefix  int      `json:"prefix,omitempty"`  // the prefix length of the address pool the IP is from
+	Routes  []string `json:"routes,omitempty"`  // the other address pools, routed through the tunnel
+}
+
+// Sent json encoded by the server in place of ClientSettings when it refuses us
+type HandshakeError struct {
+	Error string `json:"error"` // why we were refused
+}
+
+// Sent json encoded by the server in a frame of its own when it disconnects us
+// Control frames are told apart from packets by not starting with an IPv4 or IPv6 version nibble
+type ControlFrame struct {
+	Disconnect string `json:"disconnect"` // why we were disconnected
 }
 
 func main() {
@@ -97,52 +119,104 @@ func main() {
 		log.Fatalln("client: unable to allocate TUN interface:", err)
 	}
 
+	// The largest tunnel MTU we support, the server may negotiate it down
+	mtu := config.Get("tun", "mtu").Int(DefaultMTU)
+	if mtu < MinMTU || mtu > MaxMTU {
+		log.Fatalf("client: tun mtu %d must be between %d and %d", mtu, MinMTU, MaxMTU)
+	}
+
 	// Waitgroup for waiting on main services to stop
 	mainwait := &sync.WaitGroup{}
 
-	// Create pool of messages
+	// Create pool of messages large enough for any negotiated MTU
 	bufpool := sync.Pool{
 		New: func() interface{} {
-			return &message{}
+			return newmessage(mtu)
 		},
 	}
 
 	// Connect to server
-	tlscon, err := tls.Dial("tcp", config.Get("server").String("server:443"), tlsconfig)
+	server := config.Get("server").String("server:443")
+	tlscon, err := tls.Dial("tcp", server, tlsconfig)
 	if nil != err {
 		log.Fatalln("client: connect failed", err)
 	}
 
-	// Filter stack for sending packets to the tun iface
-	tuntxstack := filterstack{tuntx(iface)}
+	// Negotiate the session on the first connection
+	settings, err := handshake(tlscon, ClientInfo{
+		MTU:     mtu,
+		Subnets: config.Get("subnets").StringSlice(nil),
+	})
+	if nil != err {
+		log.Fatalf("client(term): client handshake failed: %s", err)
+	}
+
+	// The server only routes the subnets it authorized us for
+	for _, subnet := range settings.Subnets {
+		log.Printf("client: serving as gateway for %s", subnet)
+	}
+
+	// Configure the tun adapter with the negotiated settings
+	tunsetup(tunconfig.Name, settings)
+
+	// Open further connections that join the session to stripe traffic across
+	conns := []*tls.Conn{tlscon}
+	for i := 1; i < config.Get("stripes").Int(1); i++ {
+		stripecon, err := tls.Dial("tcp", server, tlsconfig)
+		if nil != err {
+			log.Fatalln("client: striped connect failed", err)
+		}
+
+		if _, err := handshake(stripecon, ClientInfo{Session: settings.Session, MTU: mtu}); nil != err {
+			log.Fatalf("client(term): striped handshake failed: %s", err)
+		}
 
+		conns = append(conns, stripecon)
+	}
+	log.Printf("client: session established with %d connections", len(conns))
+
+	// Closed to stop all of the connections, when any one of them fails or on a signal
 	done := make(chan bool)
-	go service(tlscon, tuntxstack, &bufpool, done, mainwait)
+	var once sync.Once
+	stop := func() {
+		once.Do(func() { close(done) })
+	}
 
-	// Wait until the handshake goes well
-	_, ok := <-done
+	// Filter stacks for packets from the tun iface, and for sending packets to it
+	var tunrxstack, tuntxstack filterstack
 
-	// If done was closed then there was an error negotiating the client
-	if ok {
-		// Put the conntx filter at the end of the tunrx stack
-		tunrxstack := filterstack{conntx(tlscon)}
+	// Clamp the MSS of TCP SYNs in both directions to fit the tunnel MTU
+	if config.Get("tun", "mssclamp").Bool(true) {
+		tunrxstack = append(tunrxstack, mssclamp(settings.MTU))
+		tuntxstack = append(tuntxstack, mssclamp(settings.MTU))
+	}
 
-		go tunrx(iface, tunrxstack, mainwait, &bufpool)
+	tuntxstack = append(tuntxstack, tuntx(iface))
 
-		// Handle SIGINT and SIGTERM
-		sigs := make(chan os.Signal)
-		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	// Pump each connection into the tun and collect their write filters
+	// Writes to each connection are queued by priority class
+	var conntxs []filterfunc
+	for _, conn := range conns {
+		go service(conn, tuntxstack, settings.MTU, &bufpool, done, stop, mainwait)
+		conntxs = append(conntxs, priotx(conntx(conn), settings.MTU, &bufpool, done))
+	}
 
-		select {
-		case sig := <-sigs:
-			log.Printf("client(term): got signal %s", sig)
-			close(done)
-		case <-done:
-		}
+	// Put the striping conntx filter at the end of the tunrx stack
+	tunrxstack = append(tunrxstack, stripetx(conntxs))
 
-		log.Print("client: waiting for shutdown")
-		mainwait.Wait()
-	} else {
-		log.Print("client(term): client handshake failed")
+	go tunrx(iface, tunrxstack, mainwait, &bufpool)
+
+	// Handle SIGINT and SIGTERM
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case sig := <-sigs:
+		log.Printf("client(term): got signal %s", sig)
+		stop()
+	case <-done:
 	}
+
+	log.Print("client: waiting for shutdown")
+	mainwait.Wait()
 }
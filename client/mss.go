@@ -0,0 +1,13 @@
+package main
+
+import (
+	"github.com/joshperry/govpn/mss"
+)
+
+// Filter that clamps the MSS of TCP SYNs passing through the stack to fit mtu
+func mssclamp(mtu int) filterfunc {
+	return func(msg *message, stack filterstack) error {
+		mss.Clamp(msg.packet, mtu)
+		return stack.next(msg)
+	}
+}
@@ -2,40 +2,48 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
 
+	"github.com/joshperry/govpn/flow"
 	"github.com/songgao/water"
 )
 
 type message struct {
-	buf        [MTU + 4]byte
+	buf        []byte
 	packet     []byte
 	wirepacket []byte
 	len        int
 }
 
+// Make a message with a buffer for packets up to mtu bytes plus the length header
+func newmessage(mtu int) *message {
+	return &message{buf: make([]byte, mtu+4)}
+}
+
 func (msg *message) clr() {
-	msg.wirepacket = msg.buf[:]
+	msg.wirepacket = msg.buf
 	msg.packet = msg.buf[4:]
-	msg.len = MTU
+	msg.len = len(msg.buf) - 4
 }
 
 func (msg *message) set(n int) {
-	if n != msg.len {
-		msg.len = n
-		msg.wirepacket = msg.buf[:msg.len+4]
-		msg.packet = msg.buf[4:]
-		binary.BigEndian.PutUint32(msg.wirepacket, uint32(msg.len))
-	}
+	msg.len = n
+	msg.wirepacket = msg.buf[:msg.len+4]
+	msg.packet = msg.wirepacket[4:]
+	binary.BigEndian.PutUint32(msg.wirepacket, uint32(msg.len))
 }
 
-func (msg *message) eset() error {
+// Set up the message slices from the embedded length
+// Fails if the length is larger than the negotiated mtu
+func (msg *message) eset(mtu int) error {
 	packetlen := int(binary.BigEndian.Uint32(msg.wirepacket))
-	if packetlen > MTU {
+	if packetlen > mtu || packetlen+4 > len(msg.buf) {
 		return errors.New(fmt.Sprintf("connrx(term): packetlen %d MTU too small or lost framing sync", packetlen))
 	}
 
@@ -56,7 +64,7 @@ func (stack filterstack) next(msg *message) error {
 	return stack[0](msg, stack[1:])
 }
 
-func connrx(rdr net.Conn, txstack filterstack, readerr chan<- bool, wait *sync.WaitGroup, bufpool *sync.Pool) {
+func connrx(rdr net.Conn, txstack filterstack, mtu int, readerr chan<- bool, wait *sync.WaitGroup, bufpool *sync.Pool) {
 	// Leave the wait group when the read pump exits
 	defer wait.Done()
 	defer func() {
@@ -76,15 +84,13 @@ func connrx(rdr net.Conn, txstack filterstack, readerr chan<- bool, wait *sync.W
 			bufpool.Put(msg)
 		}
 
-		if n, err := rdr.Read(msg.wirepacket[:4]); nil != err {
+		if _, err := io.ReadFull(rdr, msg.wirepacket[:4]); nil != err {
 			fatal("error while reading header", err)
-		} else if n < 4 {
-			fatal("", errors.New("short read"))
 			return
 		}
 
 		// Setup message slices from embedded length
-		if err := msg.eset(); nil != err {
+		if err := msg.eset(mtu); nil != err {
 			fatal("", err)
 			return
 		}
@@ -92,12 +98,21 @@ func connrx(rdr net.Conn, txstack filterstack, readerr chan<- bool, wait *sync.W
 		//log.Print("connrx: waiting")
 		// This ends when the connection is closed locally or remotely
 		// Read int header
-		if n, err := rdr.Read(msg.packet); nil != err {
+		if _, err := io.ReadFull(rdr, msg.packet); nil != err {
 			// Read failed, pumpexit the handler
 			fatal("error while reading body", err)
 			return
-		} else if n < msg.len {
-			fatal("", errors.New("short read"))
+		}
+
+		// The server tells us why before disconnecting us
+		if msg.len > 0 && msg.packet[0]>>4 != 4 && msg.packet[0]>>4 != 6 {
+			var frame ControlFrame
+			if err := json.Unmarshal(msg.packet, &frame); nil != err {
+				fatal("error decoding control frame", err)
+				return
+			}
+			log.Printf("connrx(term): disconnected by the server: %s", frame.Disconnect)
+			bufpool.Put(msg)
 			return
 		}
 
@@ -131,6 +146,14 @@ func conntx(conn net.Conn) filterfunc {
 	}
 }
 
+// Spreads packets across the conntx filters of the session's striped connections
+// Each flow is pinned to a single connection by its hash to keep per-flow ordering
+func stripetx(conntxs []filterfunc) filterfunc {
+	return func(msg *message, stack filterstack) error {
+		return conntxs[flow.Hash(msg.packet[:msg.len])%uint32(len(conntxs))](msg, stack)
+	}
+}
+
 func tunrx(tun *water.Interface, txstack filterstack, wait *sync.WaitGroup, bufpool *sync.Pool) {
 	//defer wait.Done() // skipped for now since tun.Close() does not kill the sleepinig read, see tunrx callsite for more
 
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/joshperry/govpn/priority"
+	"github.com/micro/go-micro/v2/config"
+)
+
+// A byte-bounded packet queue with a FIFO per priority class
+// Safe for any number of producers, with a single consumer
+type prioqueue struct {
+	sync.Mutex
+	bands    [priority.Classes][]*message // Guarded by the lock
+	bytes    int                          // Guarded by the lock
+	sched    *priority.Scheduler          // Guarded by the lock
+	ready    chan bool                    // Signalled when a message is pushed
+	classify *priority.Classifier
+	limit    int // Byte bound of the queue
+}
+
+// Add a message to the tail of the queue for its priority class
+// Returns false if it was not queued because the queue is full, the caller keeps the message
+func (q *prioqueue) push(msg *message) bool {
+	q.Lock()
+	if q.bytes+msg.len > q.limit {
+		q.Unlock()
+		return false
+	}
+
+	class := q.classify.Classify(msg.packet[:msg.len])
+	q.bands[class] = append(q.bands[class], msg)
+	q.bytes += msg.len
+	q.Unlock()
+
+	// Wake the consumer
+	select {
+	case q.ready <- true:
+	default:
+	}
+	return true
+}
+
+// Take the next message to send off the queue, from the priority class the scheduler picks
+// Returns nil when the queue is empty
+func (q *prioqueue) pop() *message {
+	q.Lock()
+	defer q.Unlock()
+
+	var heads [priority.Classes]int
+	for class, band := range q.bands {
+		if len(band) != 0 {
+			heads[class] = band[0].len
+		}
+	}
+
+	class := q.sched.Pick(heads)
+	if class < 0 {
+		return nil
+	}
+
+	msg := q.bands[class][0]
+	q.bands[class][0] = nil
+	q.bands[class] = q.bands[class][1:]
+	q.bytes -= msg.len
+	return msg
+}
+
+// Filter that queues packets for a connection by priority class
+// A goroutine writes them to next in the order the scheduler picks, so interactive packets don't wait behind bulk ones while the connection is busy
+// Packets that overflow the queue are dropped
+// The goroutine exits when done is closed
+func priotx(next filterfunc, mtu int, bufpool *sync.Pool, done <-chan bool) filterfunc {
+	q := &prioqueue{
+		sched:    priority.NewScheduler(mtu),
+		ready:    make(chan bool, 1),
+		classify: priority.NewClassifier(),
+		limit:    config.Get("queue", "bytes").Int(262144),
+	}
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				log.Print("priotx(term): done closed")
+				return
+
+			case <-q.ready:
+				for msg := q.pop(); msg != nil; msg = q.pop() {
+					// Errors are logged by conntx, and a failed connection is stopped by its read side
+					next(msg, nil)
+					bufpool.Put(msg)
+				}
+			}
+		}
+	}()
+
+	return func(msg *message, _ filterstack) error {
+		// Keep the packet and give the caller an empty message to put back on the pool
+		held := bufpool.Get().(*message)
+		*held, *msg = *msg, *held
+
+		if !q.push(held) {
+			bufpool.Put(held)
+		}
+		return nil
+	}
+}
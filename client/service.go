@@ -4,10 +4,13 @@ import (
 	"bufio"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/textproto"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,109 +18,142 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
-func service(tlscon *tls.Conn, tuntxstack filterstack, bufpool *sync.Pool, done chan bool, wait *sync.WaitGroup) {
-	defer tlscon.Close()
+// Runs the TLS and application layer handshakes on a new connection
+// Returns the settings sent back by the server
+func handshake(tlscon *tls.Conn, info ClientInfo) (ClientSettings, error) {
+	// Settings we get back from the server
+	var settings ClientSettings
 
 	if err := tlscon.Handshake(); nil != err {
-		log.Printf("client(term): tls handshake failed: %s", err)
-		close(done)
-		return
+		return settings, fmt.Errorf("tls handshake failed: %s", err)
 	} else {
 		log.Print("client: tls handshake succeeded")
 	}
 
-	// Settings we get back from the server
-	var settings ClientSettings
-
 	// Application layer handshake
-	{
-		// Create buffered reader for connection
-		bufrx := bufio.NewReader(tlscon)
-
-		// Encode client settings struct to newline delimited json and send as first packet
-		infobuf, err := json.Marshal(ClientInfo{
-			Time:    time.Now().UTC().Format(time.RFC3339),
-			Version: "0.1.0",
-		})
-		if err != nil {
-			log.Print("(term): error encoding client info packet")
-			close(done)
-			return
-		}
 
-		// Write http response and headers
-		tlscon.Write([]byte("POST / HTTP/1.0\n"))
-		tlscon.Write([]byte("Content-Type: application/json\n"))
-		tlscon.Write([]byte(fmt.Sprintf("Content-Length: %d\n", len(infobuf))))
-		tlscon.Write([]byte("\n"))
-		tlscon.Write(infobuf)
-
-		// Process the response
-		tp := textproto.NewReader(bufrx)
-		request, err := tp.ReadLine()
-		if err != nil {
-			log.Printf("(term): error reading request line: %s", err)
-			close(done)
-			return
-		}
-		log.Print(string(request))
+	// Create buffered reader for connection
+	bufrx := bufio.NewReader(tlscon)
 
-		// Get headers
-		headers, err := tp.ReadMIMEHeader()
-		if err != nil {
-			log.Printf("(term): error reading request headers: %s", err)
-			close(done)
-			return
-		}
-		log.Print("got headers")
-		log.Print(headers)
-
-		// Get body
-		bodylen, err := strconv.ParseInt(headers["Content-Length"][0], 10, 64)
-		if err != nil {
-			log.Print("(term): error parsing content-length header")
-			close(done)
-			return
-		}
+	// Encode client settings struct to newline delimited json and send as first packet
+	info.Time = time.Now().UTC().Format(time.RFC3339)
+	info.Version = "0.1.0"
+	infobuf, err := json.Marshal(info)
+	if err != nil {
+		return settings, errors.New("error encoding client info packet")
+	}
 
-		// TODO: Protect for content too large
+	// Write http response and headers
+	tlscon.Write([]byte("POST / HTTP/1.0\n"))
+	tlscon.Write([]byte("Content-Type: application/json\n"))
+	tlscon.Write([]byte(fmt.Sprintf("Content-Length: %d\n", len(infobuf))))
+	tlscon.Write([]byte("\n"))
+	tlscon.Write(infobuf)
+
+	// Process the response
+	tp := textproto.NewReader(bufrx)
+	request, err := tp.ReadLine()
+	if err != nil {
+		return settings, fmt.Errorf("error reading request line: %s", err)
+	}
+	log.Print(string(request))
 
-		body := make([]byte, bodylen)
-		n, err := bufrx.Read(body)
-		if err != nil {
-			log.Print("(term): error reading request body")
-			close(done)
-			return
-		}
-		log.Print("got body")
-		log.Print(string(body))
+	// Get headers
+	headers, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return settings, fmt.Errorf("error reading request headers: %s", err)
+	}
+	log.Print("got headers")
+	log.Print(headers)
 
-		// Decode client settings struct from json in the respnse
-		if err := json.Unmarshal(body[:n], &settings); err != nil {
-			log.Print("(term): error decoding client settings")
-			close(done)
-			return
+	// Get body
+	if len(headers["Content-Length"]) == 0 {
+		return settings, fmt.Errorf("server refused connection: %s", request)
+	}
+	bodylen, err := strconv.ParseInt(headers["Content-Length"][0], 10, 64)
+	if err != nil {
+		return settings, errors.New("error parsing content-length header")
+	}
+
+	// TODO: Protect for content too large
+
+	body := make([]byte, bodylen)
+	n, err := bufrx.Read(body)
+	if err != nil {
+		return settings, errors.New("error reading request body")
+	}
+	log.Print("got body")
+	log.Print(string(body))
+
+	// Refusals carry the reason in the body
+	if !strings.Contains(request, " 200 ") {
+		var herr HandshakeError
+		if err := json.Unmarshal(body[:n], &herr); err != nil || herr.Error == "" {
+			return settings, fmt.Errorf("server refused connection: %s", request)
 		}
+		return settings, fmt.Errorf("server refused connection: %s: %s", request, herr.Error)
+	}
+
+	// Decode client settings struct from json in the respnse
+	if err := json.Unmarshal(body[:n], &settings); err != nil {
+		return settings, errors.New("error decoding client settings")
+	}
+
+	// The server must not negotiate an MTU larger than ours
+	if settings.MTU == 0 || settings.MTU > info.MTU {
+		return settings, fmt.Errorf("server negotiated unsupported mtu %d", settings.MTU)
+	}
+
+	// Ensure the buffered reader doesn't hold further data
+	if bufrx.Buffered() != 0 {
+		panic("Didn't read all buffered bytes")
+	}
 
-		// TODO: Set tun adapter IP address and state
+	return settings, nil
+}
 
-		// Set tun adapter settings and turn it up
-		// TODO: Make more bulletproof/config
-		nlhand, _ := netlink.NewHandle()
-		tunlink, _ := netlink.LinkByName("tun_govpnc")
-		ipnet, _ := netlink.ParseAddr(settings.IP + "/21")
-		netlink.AddrAdd(tunlink, ipnet)
-		nlhand.LinkSetMTU(tunlink, MTU)
-		nlhand.LinkSetUp(tunlink)
+// Set tun adapter settings from the server and turn it up
+func tunsetup(name string, settings ClientSettings) {
+	// TODO: Make more bulletproof/config
+	nlhand, _ := netlink.NewHandle()
+	tunlink, _ := netlink.LinkByName(name)
+	// Servers from before address pools don't send the prefix
+	prefix := settings.Prefix
+	if prefix == 0 {
+		prefix = 21
+	}
+	ipnet, _ := netlink.ParseAddr(fmt.Sprintf("%s/%d", settings.IP, prefix))
+	netlink.AddrAdd(tunlink, ipnet)
+	nlhand.LinkSetMTU(tunlink, settings.MTU)
+
+	// Enable ipv6 on the tun interface only when the server gave us an address
+	if settings.IP6 != "" {
+		sysctl.Set(fmt.Sprintf("net.ipv6.conf.%s.disable_ipv6", name), "0")
+		if ipnet6, err := netlink.ParseAddr(settings.IP6); nil != err {
+			log.Printf("client: bad ipv6 address from server %q: %s", settings.IP6, err)
+		} else {
+			netlink.AddrAdd(tunlink, ipnet6)
+		}
+	} else {
+		sysctl.Set(fmt.Sprintf("net.ipv6.conf.%s.disable_ipv6", name), "1")
+	}
 
-		// Disable ipv6 on tun interface
-		err = sysctl.Set("net.ipv6.conf.tun_govpnc.disable_ipv6", "1")
+	nlhand.LinkSetUp(tunlink)
 
-		// Ensure the buffered reader doesn't hold further data
-		if bufrx.Buffered() != 0 {
-			panic("Didn't read all buffered bytes")
+	// The server and clients in the other address pools are reached through the tunnel
+	for _, cidr := range settings.Routes {
+		if _, dst, err := net.ParseCIDR(cidr); nil != err {
+			log.Printf("client: bad route from server %q: %s", cidr, err)
+		} else if err := netlink.RouteReplace(&netlink.Route{LinkIndex: tunlink.Attrs().Index, Dst: dst}); nil != err {
+			log.Printf("client: failed adding route %s: %s", cidr, err)
 		}
 	}
+}
+
+// Pumps packets from a connection with a completed handshake into the tun
+// Calls stop when reading from the server fails, and exits when done is closed
+func service(tlscon *tls.Conn, tuntxstack filterstack, mtu int, bufpool *sync.Pool, done <-chan bool, stop func(), wait *sync.WaitGroup) {
+	defer tlscon.Close()
 
 	// A channel to signal a write error to the server
 	readerr := make(chan bool)
@@ -125,10 +161,7 @@ func service(tlscon *tls.Conn, tuntxstack filterstack, bufpool *sync.Pool, done
 	// Channel for packets coming from the server
 	// Exits when the read fails
 	wait.Add(1)
-	go connrx(tlscon, tuntxstack, readerr, wait, bufpool)
-
-	// Signal ready for tun traffic
-	done <- true
+	go connrx(tlscon, tuntxstack, mtu, readerr, wait, bufpool)
 
 	// Block waiting for a signal, or an error
 	for {
@@ -139,7 +172,7 @@ func service(tlscon *tls.Conn, tuntxstack filterstack, bufpool *sync.Pool, done
 
 		case <-readerr:
 			log.Println("client(term): error reading from server")
-			close(done)
+			stop()
 			return
 
 		}
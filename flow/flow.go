@@ -0,0 +1,52 @@
+// Hashes packets by the flow they belong to, so every packet of a flow takes the same queue or connection
+// Shared by the client and server
+package flow
+
+import (
+	"github.com/joshperry/govpn/ipv6"
+)
+
+// Hash the fields identifying the flow of an IPv4 or IPv6 packet with FNV-1a
+// Ports are only included for unfragmented TCP and UDP packets
+func Hash(packet []byte) uint32 {
+	if len(packet) < 20 {
+		return 0
+	}
+
+	hash := uint32(2166136261)
+	mix := func(buf []byte) {
+		for _, b := range buf {
+			hash ^= uint32(b)
+			hash *= 16777619
+		}
+	}
+
+	if packet[0]>>4 == 6 {
+		if len(packet) < 40 {
+			return 0
+		}
+
+		// Source and destination addresses, and the protocol and ports of TCP and UDP past any extension headers
+		// Later fragments carry no ports, so fragmented packets hash by address and protocol alone
+		mix(packet[8:40])
+		proto, off, fragmented := ipv6.Transport(packet)
+		mix([]byte{byte(proto)})
+		if (proto == 6 || proto == 17) && !fragmented && len(packet) >= off+4 {
+			mix(packet[off : off+4])
+		}
+		return hash
+	}
+
+	// Protocol, source and destination addresses
+	mix(packet[9:10])
+	mix(packet[12:20])
+
+	// Ports when this is an unfragmented TCP or UDP packet
+	hdrlen := (int(packet[0]) & 0x0F) * 4
+	fragmented := packet[6]&0x3F != 0 || packet[7] != 0 // MF flag or fragment offset
+	if (packet[9] == 6 || packet[9] == 17) && !fragmented && len(packet) >= hdrlen+4 {
+		mix(packet[hdrlen : hdrlen+4])
+	}
+
+	return hash
+}
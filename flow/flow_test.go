@@ -0,0 +1,79 @@
+package flow
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// An IPv6 UDP packet from sport to dport, behind a hop-by-hop options header when hopbyhop is set
+// A fragment header with offset and more flag goes in front of the UDP header when fragment is set
+func udp6(sport uint16, dport uint16, hopbyhop bool, fragment bool, offset uint16, more bool) []byte {
+	packet := make([]byte, 40)
+	packet[0] = 0x60
+	packet[7] = 64
+	copy(packet[8:24], []byte{0x20, 0x01, 0x0d, 0xb8, 15: 2})
+	copy(packet[24:40], []byte{0x20, 0x01, 0x0d, 0xb8, 15: 3})
+
+	next := 6
+	if hopbyhop {
+		packet[next] = 0
+		next = len(packet)
+		packet = append(packet, 0, 0, 1, 4, 0, 0, 0, 0)
+	}
+	if fragment {
+		packet[next] = 44
+		next = len(packet)
+		frag := make([]byte, 8)
+		field := offset << 3
+		if more {
+			field |= 1
+		}
+		binary.BigEndian.PutUint16(frag[2:], field)
+		packet = append(packet, frag...)
+	}
+	packet[next] = 17
+
+	if offset == 0 {
+		hdr := make([]byte, 8)
+		binary.BigEndian.PutUint16(hdr[0:], sport)
+		binary.BigEndian.PutUint16(hdr[2:], dport)
+		packet = append(packet, hdr...)
+	}
+	packet = append(packet, make([]byte, 16)...)
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(packet)-40))
+	return packet
+}
+
+// Ports decide the flow past IPv6 extension headers, and every fragment of a packet takes the same flow
+func TestHashIPv6(t *testing.T) {
+	if Hash(udp6(1000, 53, true, false, 0, false)) == Hash(udp6(1001, 53, true, false, 0, false)) {
+		t.Error("ports behind a hop-by-hop header don't change the hash")
+	}
+	if Hash(udp6(1000, 53, false, false, 0, false)) != Hash(udp6(1000, 53, true, false, 0, false)) {
+		t.Error("a hop-by-hop header changes the hash of its flow")
+	}
+	if Hash(udp6(1000, 53, false, true, 0, true)) != Hash(udp6(1000, 53, false, true, 185, false)) {
+		t.Error("the first and a later fragment hash differently")
+	}
+}
+
+// Every fragment of an IPv4 packet takes the same flow, hashed without ports
+func TestHashIPv4Fragments(t *testing.T) {
+	packet := func(sport uint16, frag uint16) []byte {
+		p := make([]byte, 36)
+		p[0] = 0x45
+		p[9] = 17
+		binary.BigEndian.PutUint16(p[6:], frag)
+		copy(p[12:20], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+		binary.BigEndian.PutUint16(p[20:], sport)
+		binary.BigEndian.PutUint16(p[22:], 53)
+		return p
+	}
+
+	if Hash(packet(1000, 0)) == Hash(packet(1001, 0)) {
+		t.Error("ports don't change the hash")
+	}
+	if Hash(packet(1000, 0x2000)) != Hash(packet(1001, 0x00b9)) {
+		t.Error("the first and a later fragment hash differently")
+	}
+}
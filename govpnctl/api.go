@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A session as reported by the admin API
+type Session struct {
+	ID       string   `json:"id"`
+	Time     string   `json:"time"`
+	Name     string   `json:"name"`
+	Groups   []string `json:"groups"`
+	IP       string   `json:"ip"`
+	IP6      string   `json:"ip6"`
+	PublicIP string   `json:"publicip"`
+	Pool     string   `json:"pool"`
+	Sticky   bool     `json:"sticky"`
+	MTU      int      `json:"mtu"`
+	Subnets  []string `json:"subnets"`
+	Pending  bool     `json:"pending"`
+
+	UpPackets   uint64 `json:"uppackets"`
+	UpBytes     uint64 `json:"upbytes"`
+	DownPackets uint64 `json:"downpackets"`
+	DownBytes   uint64 `json:"downbytes"`
+}
+
+// A page of the session list
+type SessionPage struct {
+	Total    int       `json:"total"`
+	Offset   int       `json:"offset"`
+	Sessions []Session `json:"sessions"`
+}
+
+// An address lease as reported by the admin API
+type Lease struct {
+	IP       string `json:"ip"`
+	Name     string `json:"name"`
+	Pool     string `json:"pool"`
+	Node     string `json:"node"`
+	Active   bool   `json:"active"`
+	Reserved bool   `json:"reserved"`
+	Expires  string `json:"expires"`
+}
+
+// Makes requests of the admin API
+type adminclient struct {
+	base   string
+	client *http.Client
+}
+
+// Make a client for the admin API at opts.server
+// https servers are sent the client certificate in opts.cert and opts.key
+// Their certificate is verified against opts.ca, or the system roots, for the name in opts.name, or the host of opts.server
+func newadminclient(opts options) (*adminclient, error) {
+	base, err := url.Parse(opts.server)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{}
+	if base.Scheme == "https" {
+		tlsconfig := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: opts.name}
+
+		if opts.cert != "" || opts.key != "" {
+			cer, err := tls.LoadX509KeyPair(opts.cert, opts.key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate: %s", err)
+			}
+			tlsconfig.Certificates = []tls.Certificate{cer}
+		}
+
+		if opts.ca != "" {
+			pem, err := ioutil.ReadFile(opts.ca)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read certificate authority: %s", err)
+			}
+			certpool := x509.NewCertPool()
+			if !certpool.AppendCertsFromPEM(pem) {
+				return nil, errors.New("failed to parse certificate authority")
+			}
+			tlsconfig.RootCAs = certpool
+		}
+
+		transport.TLSClientConfig = tlsconfig
+	}
+
+	return &adminclient{
+		base:   strings.TrimSuffix(opts.server, "/") + "/admin",
+		client: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Make a request of the admin API, sending body as json when it isn't nil
+// Returns the response body, or an error with the API's message when it didn't succeed
+func (a *adminclient) do(method string, path string, body interface{}) ([]byte, error) {
+	var reqbody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqbody).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, a.base+path, &reqbody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respbody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(respbody)))
+	}
+	return respbody, nil
+}
+
+// Make a request and decode its json response into v
+func (a *adminclient) get(path string, v interface{}) ([]byte, error) {
+	respbody, err := a.do(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return respbody, json.Unmarshal(respbody, v)
+}
+
+// Get every session matching query, paging through the list
+func (a *adminclient) sessions(query url.Values) ([]Session, error) {
+	var all []Session
+	for {
+		query.Set("offset", fmt.Sprint(len(all)))
+		query.Set("limit", "500")
+
+		var page SessionPage
+		if _, err := a.get("/sessions?"+query.Encode(), &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page.Sessions...)
+
+		if len(page.Sessions) == 0 || len(all) >= page.Total {
+			return all, nil
+		}
+	}
+}
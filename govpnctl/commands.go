@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Print the API's json response indented
+func printjson(respbody []byte) error {
+	var out bytes.Buffer
+	if err := json.Indent(&out, respbody, "", "  "); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err := out.WriteTo(os.Stdout)
+	return err
+}
+
+// A table written to stdout when flushed, with columns separated by tabs
+func newtable(header ...string) *tabwriter.Writer {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	return w
+}
+
+// Format a byte count with a binary unit
+func humanbytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
+
+// How long ago an RFC3339 time was, to the second
+func since(stamp string) string {
+	t, err := time.Parse(time.RFC3339, stamp)
+	if err != nil {
+		return stamp
+	}
+	return time.Since(t).Round(time.Second).String()
+}
+
+// The session's state, open or waiting to disconnect
+func state(s Session) string {
+	if s.Pending {
+		return "pending"
+	}
+	return "open"
+}
+
+// List sessions matching the filter flags, or show the one with the id given
+func sessions(api *adminclient, opts options, args []string) error {
+	flags := flag.NewFlagSet("sessions", flag.ExitOnError)
+	name := flags.String("name", "", "only sessions of this identity")
+	group := flags.String("group", "", "only sessions of identities in this group")
+	pool := flags.String("pool", "", "only sessions with an address from this pool")
+	ip := flags.String("ip", "", "only the session with this tunnel address")
+	pending := flags.Bool("pending", false, "only sessions waiting to disconnect")
+	flags.Parse(args)
+
+	if flags.NArg() == 1 {
+		var session Session
+		respbody, err := api.get("/sessions/"+url.PathEscape(flags.Arg(0)), &session)
+		if err != nil {
+			return err
+		}
+		if opts.json {
+			return printjson(respbody)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "id\t%s\n", session.ID)
+		fmt.Fprintf(w, "name\t%s\n", session.Name)
+		fmt.Fprintf(w, "groups\t%s\n", strings.Join(session.Groups, ", "))
+		fmt.Fprintf(w, "state\t%s\n", state(session))
+		fmt.Fprintf(w, "connected\t%s (%s ago)\n", session.Time, since(session.Time))
+		fmt.Fprintf(w, "public ip\t%s\n", session.PublicIP)
+		fmt.Fprintf(w, "ip\t%s\n", session.IP)
+		if session.IP6 != "" {
+			fmt.Fprintf(w, "ip6\t%s\n", session.IP6)
+		}
+		fmt.Fprintf(w, "pool\t%s (sticky %t)\n", session.Pool, session.Sticky)
+		fmt.Fprintf(w, "mtu\t%d\n", session.MTU)
+		if len(session.Subnets) != 0 {
+			fmt.Fprintf(w, "subnets\t%s\n", strings.Join(session.Subnets, ", "))
+		}
+		fmt.Fprintf(w, "up\t%s in %d packets\n", humanbytes(float64(session.UpBytes)), session.UpPackets)
+		fmt.Fprintf(w, "down\t%s in %d packets\n", humanbytes(float64(session.DownBytes)), session.DownPackets)
+		return w.Flush()
+	} else if flags.NArg() > 1 {
+		return errors.New("at most one session id")
+	}
+
+	query := url.Values{}
+	for key, value := range map[string]string{"name": *name, "group": *group, "pool": *pool, "ip": *ip} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	if *pending {
+		query.Set("pending", "true")
+	}
+
+	list, err := api.sessions(query)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		respbody, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+		return printjson(respbody)
+	}
+
+	w := newtable("ID", "NAME", "STATE", "IP", "PUBLIC IP", "POOL", "CONNECTED", "UP", "DOWN")
+	for _, s := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.Name, state(s), s.IP, s.PublicIP, s.Pool, since(s.Time), humanbytes(float64(s.UpBytes)), humanbytes(float64(s.DownBytes)))
+	}
+	return w.Flush()
+}
+
+// Disconnect a session by id, like 0x1f, or every session of an identity by name
+func kick(api *adminclient, opts options, args []string) error {
+	flags := flag.NewFlagSet("kick", flag.ExitOnError)
+	reason := flags.String("reason", "", "the reason sent to the client")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("a session id or identity name is needed")
+	}
+	target := flags.Arg(0)
+
+	body := map[string]string{"reason": *reason}
+	if strings.HasPrefix(target, "0x") {
+		if _, err := api.do(http.MethodDelete, "/sessions/"+url.PathEscape(target), body); err != nil {
+			return err
+		}
+		fmt.Printf("disconnected session %s\n", target)
+		return nil
+	}
+
+	respbody, err := api.do(http.MethodDelete, "/identities/"+url.PathEscape(target)+"/sessions", body)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printjson(respbody)
+	}
+
+	var resp struct {
+		Disconnected int `json:"disconnected"`
+	}
+	if err := json.Unmarshal(respbody, &resp); err != nil {
+		return err
+	}
+	fmt.Printf("disconnected %d sessions of %s\n", resp.Disconnected, target)
+	return nil
+}
+
+// List the address leases
+func leases(api *adminclient, opts options, args []string) error {
+	var list []Lease
+	respbody, err := api.get("/leases", &list)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printjson(respbody)
+	}
+
+	w := newtable("IP", "NAME", "POOL", "NODE", "STATE", "EXPIRES")
+	for _, l := range list {
+		state := "idle"
+		if l.Active {
+			state = "active"
+		} else if l.Reserved {
+			state = "reserved"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", l.IP, l.Name, l.Pool, l.Node, state, l.Expires)
+	}
+	return w.Flush()
+}
+
+// Reload the server config
+func reload(api *adminclient, opts options, args []string) error {
+	if _, err := api.do(http.MethodPost, "/reload", nil); err != nil {
+		return err
+	}
+	fmt.Println("reloaded")
+	return nil
+}
+
+// Start draining the server, stop, or show whether it is
+func drain(api *adminclient, opts options, args []string) error {
+	flags := flag.NewFlagSet("drain", flag.ExitOnError)
+	kick := flags.Bool("kick", false, "also disconnect every session, so clients reconnect to other servers")
+	reason := flags.String("reason", "", "the reason sent to refused and disconnected clients")
+	off := flags.Bool("off", false, "stop draining")
+	status := flags.Bool("status", false, "show whether the server is draining")
+	flags.Parse(args)
+
+	switch {
+	case *status:
+		var resp struct {
+			Draining bool   `json:"draining"`
+			Reason   string `json:"reason"`
+		}
+		respbody, err := api.get("/drain", &resp)
+		if err != nil {
+			return err
+		}
+		if opts.json {
+			return printjson(respbody)
+		}
+		if resp.Draining {
+			fmt.Printf("draining: %s\n", resp.Reason)
+		} else {
+			fmt.Println("not draining")
+		}
+
+	case *off:
+		if _, err := api.do(http.MethodDelete, "/drain", nil); err != nil {
+			return err
+		}
+		fmt.Println("stopped draining")
+
+	default:
+		respbody, err := api.do(http.MethodPut, "/drain", map[string]interface{}{"reason": *reason, "kick": *kick})
+		if err != nil {
+			return err
+		}
+		if opts.json {
+			return printjson(respbody)
+		}
+
+		var resp struct {
+			Disconnected int `json:"disconnected"`
+		}
+		if err := json.Unmarshal(respbody, &resp); err != nil {
+			return err
+		}
+		fmt.Printf("draining, disconnected %d sessions\n", resp.Disconnected)
+	}
+	return nil
+}
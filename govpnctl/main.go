@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+/**
+* govpnctl talks to the admin API of a govpn server
+* See api.go for the requests, and commands.go and top.go for what is done with them
+ */
+
+// Flags shared by every command
+type options struct {
+	server string // base url of the admin API
+	cert   string // client certificate for TLS client auth
+	key    string
+	ca     string // CA of the admin API's certificate, the system roots when empty
+	name   string // name to verify the admin API's certificate against, the host of server when empty
+	json   bool   // print the API's json instead of tables
+}
+
+// A command and what it's for
+type command struct {
+	name  string
+	usage string
+	run   func(api *adminclient, opts options, args []string) error
+}
+
+var commands = []command{
+	{"sessions", "[-name n] [-group g] [-pool p] [-ip a] [-pending] [id]  list sessions, or show one", sessions},
+	{"kick", "[-reason r] <id|name>  disconnect a session by id, or every session of an identity", kick},
+	{"leases", "  list the address leases", leases},
+	{"reload", "  reload the server config", reload},
+	{"drain", "[-kick] [-reason r] | -off | -status  refuse new sessions, or stop", drain},
+	{"top", "[-interval d] [-n count]  live per-session throughput", top},
+}
+
+// Use the environment for a flag's default
+func env(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: govpnctl [flags] <command> [command flags]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.server, "server", env("GOVPNCTL_SERVER", "https://127.0.0.1:9443"), "admin API url (GOVPNCTL_SERVER)")
+	flag.StringVar(&opts.cert, "cert", env("GOVPNCTL_CERT", ""), "client certificate for the admin API (GOVPNCTL_CERT)")
+	flag.StringVar(&opts.key, "key", env("GOVPNCTL_KEY", ""), "client certificate key (GOVPNCTL_KEY)")
+	flag.StringVar(&opts.ca, "ca", env("GOVPNCTL_CA", ""), "certificate authority of the admin API, the system roots when unset (GOVPNCTL_CA)")
+	flag.StringVar(&opts.name, "servername", env("GOVPNCTL_SERVERNAME", ""), "name to verify the admin API's certificate against, the host of -server when unset (GOVPNCTL_SERVERNAME)")
+	flag.BoolVar(&opts.json, "json", false, "print json instead of tables")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	api, err := newadminclient(opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "govpnctl: %s\n", err)
+		os.Exit(1)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == flag.Arg(0) {
+			if err := cmd.run(api, opts, flag.Args()[1:]); err != nil {
+				fmt.Fprintf(os.Stderr, "govpnctl: %s: %s\n", cmd.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "govpnctl: unknown command %q\n", flag.Arg(0))
+	usage()
+	os.Exit(2)
+}
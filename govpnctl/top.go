@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+)
+
+// A session's throughput between two samples, in bytes and packets per second
+type Rate struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	IP          string  `json:"ip"`
+	UpBytes     float64 `json:"upbytes"`
+	DownBytes   float64 `json:"downbytes"`
+	UpPackets   float64 `json:"uppackets"`
+	DownPackets float64 `json:"downpackets"`
+}
+
+// Work out the rates of the sessions in cur since they were in prev, busiest first
+// Sessions that weren't in prev are measured from zero, since they connected in between
+func rates(prev map[string]Session, cur []Session, elapsed time.Duration) []Rate {
+	secs := elapsed.Seconds()
+	var list []Rate
+	for _, s := range cur {
+		last := prev[s.ID]
+		list = append(list, Rate{
+			ID:          s.ID,
+			Name:        s.Name,
+			IP:          s.IP,
+			UpBytes:     float64(s.UpBytes-last.UpBytes) / secs,
+			DownBytes:   float64(s.DownBytes-last.DownBytes) / secs,
+			UpPackets:   float64(s.UpPackets-last.UpPackets) / secs,
+			DownPackets: float64(s.DownPackets-last.DownPackets) / secs,
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		ti, tj := list[i].UpBytes+list[i].DownBytes, list[j].UpBytes+list[j].DownBytes
+		if ti != tj {
+			return ti > tj
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Show the throughput of the busiest sessions, refreshed every interval until interrupted
+// With -json each refresh is printed as a line of json instead
+func top(api *adminclient, opts options, args []string) error {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	interval := flags.Duration("interval", 2*time.Second, "time between refreshes")
+	count := flags.Int("n", 20, "sessions to show, 0 for all")
+	flags.Parse(args)
+
+	if *interval <= 0 {
+		*interval = 2 * time.Second
+	}
+
+	sample := func() (map[string]Session, []Session, time.Time, error) {
+		list, err := api.sessions(url.Values{"pending": {"false"}})
+		byid := make(map[string]Session, len(list))
+		for _, s := range list {
+			byid[s.ID] = s
+		}
+		return byid, list, time.Now(), err
+	}
+
+	prev, _, prevtime, err := sample()
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		byid, list, now, err := sample()
+		if err != nil {
+			return err
+		}
+
+		// Sessions that reconnected between samples start over, rather than showing a huge negative rate
+		for id, s := range byid {
+			if last, ok := prev[id]; ok && (s.UpBytes < last.UpBytes || s.DownBytes < last.DownBytes) {
+				delete(prev, id)
+			}
+		}
+
+		busiest := rates(prev, list, now.Sub(prevtime))
+		prev, prevtime = byid, now
+
+		var totalup, totaldown float64
+		for _, r := range busiest {
+			totalup += r.UpBytes
+			totaldown += r.DownBytes
+		}
+		if *count > 0 && len(busiest) > *count {
+			busiest = busiest[:*count]
+		}
+
+		if opts.json {
+			if err := json.NewEncoder(os.Stdout).Encode(busiest); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Clear the terminal and draw from the top
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("govpnctl top - %s  %d sessions  up %s/s  down %s/s\n\n", now.Format("15:04:05"), len(list), humanbytes(totalup), humanbytes(totaldown))
+
+		w := newtable("ID", "NAME", "IP", "UP/S", "DOWN/S", "UP PKT/S", "DOWN PKT/S")
+		for _, r := range busiest {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%.0f\t%.0f\n", r.ID, r.Name, r.IP, humanbytes(r.UpBytes), humanbytes(r.DownBytes), r.UpPackets, r.DownPackets)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+// Walks the header chains of IPv6 packets
+// Shared by the client and server
+package ipv6
+
+import (
+	"encoding/binary"
+)
+
+// The upper layer protocol of an IPv6 packet and the offset of its header, past any hop-by-hop, routing, destination options, and fragment headers
+// fragmented is set when there is a fragment header, and the offset is -1 when this is a later fragment, which carries no upper layer header
+// The protocol is -1 when the header chain runs past the end of the packet, so callers can refuse what they can't inspect
+func Transport(packet []byte) (proto int, off int, fragmented bool) {
+	if len(packet) < 40 {
+		return -1, -1, false
+	}
+
+	end := 40 + int(binary.BigEndian.Uint16(packet[4:]))
+	if end > len(packet) {
+		end = len(packet)
+	}
+
+	proto, off = int(packet[6]), 40
+	for {
+		switch proto {
+		case 0, 43, 60: // Hop-by-hop, routing, destination options
+			if off+8 > end {
+				return -1, -1, fragmented
+			}
+			proto, off = int(packet[off]), off+(int(packet[off+1])+1)*8
+
+		case 44: // Fragment
+			if off+8 > end {
+				return -1, -1, fragmented
+			}
+			fragmented = true
+			if binary.BigEndian.Uint16(packet[off+2:])&0xFFF8 != 0 {
+				return int(packet[off]), -1, true
+			}
+			proto, off = int(packet[off]), off+8
+
+		default:
+			if off > end {
+				return -1, -1, fragmented
+			}
+			return proto, off, fragmented
+		}
+	}
+}
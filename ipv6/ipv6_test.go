@@ -0,0 +1,72 @@
+package ipv6
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// Build an IPv6 packet with the extension headers in chain followed by an upper layer header of proto
+// Each extension header is given as its type and length in bytes, fragment headers take the offset in 8 byte units as their length
+func packet6(chain [][2]int, proto int, payload int) []byte {
+	packet := make([]byte, 40)
+	packet[0] = 0x60
+
+	next := 6
+	for i, ext := range chain {
+		if i == 0 {
+			packet[6] = byte(ext[0])
+		} else {
+			packet[next] = byte(ext[0])
+		}
+
+		next = len(packet)
+		if ext[0] == 44 {
+			hdr := make([]byte, 8)
+			binary.BigEndian.PutUint16(hdr[2:], uint16(ext[1]<<3))
+			packet = append(packet, hdr...)
+		} else {
+			hdr := make([]byte, ext[1])
+			hdr[1] = byte(ext[1]/8 - 1)
+			packet = append(packet, hdr...)
+		}
+	}
+	if len(chain) == 0 {
+		packet[6] = byte(proto)
+	} else {
+		packet[next] = byte(proto)
+	}
+
+	packet = append(packet, make([]byte, payload)...)
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(packet)-40))
+	return packet
+}
+
+func TestTransport(t *testing.T) {
+	tests := []struct {
+		name       string
+		packet     []byte
+		proto      int
+		off        int
+		fragmented bool
+	}{
+		{"short", make([]byte, 20), -1, -1, false},
+		{"no extension headers", packet6(nil, 6, 20), 6, 40, false},
+		{"hop-by-hop", packet6([][2]int{{0, 8}}, 17, 8), 17, 48, false},
+		{"routing and destination options", packet6([][2]int{{43, 24}, {60, 16}}, 6, 20), 6, 80, false},
+		{"first fragment", packet6([][2]int{{0, 8}, {44, 0}}, 6, 20), 6, 56, true},
+		{"later fragment", packet6([][2]int{{44, 100}}, 6, 20), 6, -1, true},
+		{"truncated options", packet6([][2]int{{60, 16}}, 6, 0)[:50], -1, -1, false},
+		{"options past the payload length", func() []byte {
+			p := packet6([][2]int{{60, 16}}, 6, 20)
+			binary.BigEndian.PutUint16(p[4:], 8)
+			return p
+		}(), -1, -1, false},
+	}
+
+	for _, test := range tests {
+		proto, off, fragmented := Transport(test.packet)
+		if proto != test.proto || off != test.off || fragmented != test.fragmented {
+			t.Errorf("%s: got %d, %d, %t, want %d, %d, %t", test.name, proto, off, fragmented, test.proto, test.off, test.fragmented)
+		}
+	}
+}
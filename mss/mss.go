@@ -0,0 +1,122 @@
+// Clamps the MSS option of TCP SYNs so segments fit the tunnel MTU
+// Shared by the client and server
+package mss
+
+import (
+	"encoding/binary"
+
+	"github.com/joshperry/govpn/ipv6"
+)
+
+// The IP and TCP header bytes that an MSS leaves room for in the MTU, for each family
+const (
+	Overhead4 = 40
+	Overhead6 = 60
+)
+
+// Rewrite the MSS option of an IPv4 or IPv6 TCP SYN or SYN-ACK packet down to what fits in mtu
+// The TCP checksum is fixed up incrementally (RFC 1624)
+// Returns true if the packet was changed
+func Clamp(packet []byte, mtu int) bool {
+	if len(packet) < 20 {
+		return false
+	}
+
+	// Only unfragmented TCP packets, past any IPv6 extension headers
+	var hdrlen, overhead int
+	switch packet[0] >> 4 {
+	case 4:
+		if packet[9] != 6 || packet[6]&0x1F != 0 || packet[7] != 0 {
+			return false
+		}
+		hdrlen, overhead = (int(packet[0])&0x0F)*4, Overhead4
+	case 6:
+		proto, off, fragmented := ipv6.Transport(packet)
+		if proto != 6 || fragmented {
+			return false
+		}
+		hdrlen, overhead = off, Overhead6
+	default:
+		return false
+	}
+	if mtu <= overhead || len(packet) < hdrlen+20 {
+		return false
+	}
+	mss := uint16(mtu - overhead)
+	tcp := packet[hdrlen:]
+
+	// Only SYN packets carry the MSS option
+	if tcp[13]&0x02 == 0 {
+		return false
+	}
+
+	optend := int(tcp[12]>>4) * 4
+	if optend > len(tcp) {
+		return false
+	}
+
+	// Walk the options looking for the MSS
+	for i := 20; i < optend; {
+		switch tcp[i] {
+		case 0: // End of options
+			return false
+		case 1: // No-op
+			i++
+			continue
+		}
+
+		if i+1 >= optend || tcp[i+1] < 2 {
+			return false
+		}
+		optlen := int(tcp[i+1])
+
+		if tcp[i] == 2 && optlen == 4 && i+4 <= optend {
+			if binary.BigEndian.Uint16(tcp[i+2:]) <= mss {
+				return false
+			}
+
+			var val [2]byte
+			binary.BigEndian.PutUint16(val[:], mss)
+			rewrite(tcp, 16, i+2, val[:])
+			return true
+		}
+
+		i += optlen
+	}
+
+	return false
+}
+
+// Overwrite bytes of buf at off with val, fixing up the ones complement checksum at csumoff
+// The checksum must not fall within the rewritten bytes
+func rewrite(buf []byte, csumoff int, off int, val []byte) {
+	// The range of 16-bit words covered by the change
+	start := off &^ 1
+	end := (off + len(val) + 1) &^ 1
+
+	// Subtract the old words from the checksum
+	sum := uint32(^binary.BigEndian.Uint16(buf[csumoff:]))
+	for i := start; i < end; i += 2 {
+		sum += uint32(^word(buf, i))
+	}
+
+	copy(buf[off:], val)
+
+	// And add the new ones
+	for i := start; i < end; i += 2 {
+		sum += uint32(word(buf, i))
+	}
+
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	binary.BigEndian.PutUint16(buf[csumoff:], ^uint16(sum))
+}
+
+// Read the 16-bit word at off, padding with zero past the end of buf
+func word(buf []byte, off int) uint16 {
+	if off+1 < len(buf) {
+		return binary.BigEndian.Uint16(buf[off:])
+	}
+	return uint16(buf[off]) << 8
+}
@@ -0,0 +1,219 @@
+package mss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/joshperry/govpn/ipv6"
+)
+
+// Decode a packet capture, failing the test on bad hex
+func capture(t *testing.T, s string) []byte {
+	t.Helper()
+	packet, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad capture: %s", err)
+	}
+	return packet
+}
+
+// The offset of the TCP header of an IPv4 or IPv6 packet
+func tcpoffset(packet []byte) int {
+	if packet[0]>>4 == 6 {
+		_, off, _ := ipv6.Transport(packet)
+		return off
+	}
+	return (int(packet[0]) & 0x0F) * 4
+}
+
+// Check the TCP checksum of an IPv4 or IPv6 packet, including its pseudo-header
+func tcpchecksumok(packet []byte) bool {
+	tcp := packet[tcpoffset(packet):]
+
+	// The addresses in the pseudo-header
+	addrs := packet[12:20]
+	if packet[0]>>4 == 6 {
+		addrs = packet[8:40]
+	}
+
+	var sum uint32
+	for i := 0; i < len(addrs); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(addrs[i:]))
+	}
+	sum += 6 + uint32(len(tcp))
+	for i := 0; i < len(tcp); i += 2 {
+		if i+1 < len(tcp) {
+			sum += uint32(binary.BigEndian.Uint16(tcp[i:]))
+		} else {
+			sum += uint32(tcp[i]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return sum == 0xffff
+}
+
+func TestClamp(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  string
+		mtu     int
+		changed bool
+		want    uint16 // the MSS option after clamping, when changed
+		optoff  int    // offset of the MSS option's value in the packet
+	}{
+		{
+			// Linux SYN captured on loopback, with MSS, SACK permitted, timestamps, and window scale
+			// The offloaded checksum is filled in
+			name:    "syn with options",
+			packet:  "4500003cba194000400682a07f0000017f000001d024d12bdb640dcd00000000a002ffd7f65200000204ffd70402080ac16c0dbd000000000103030a",
+			mtu:     1400,
+			changed: true,
+			want:    1360,
+			optoff:  42,
+		},
+		{
+			// The SYN-ACK answering it
+			name:    "syn-ack with options",
+			packet:  "4500003c0000400040063cba7f0000017f000001d12bd024623ae971db640dcea012ffcb3ab700000204ffd70402080a32b83d32c16c0dbd0103030a",
+			mtu:     1300,
+			changed: true,
+			want:    1260,
+			optoff:  42,
+		},
+		{
+			// SYN with an IPv4 router alert option ahead of the TCP header
+			name:    "syn with ip options",
+			packet:  "460000341c4640004006499d0a0000025db8d82294040000d43401bb99aabbcc000000007002faf01ceb0000020405b401010402",
+			mtu:     1400,
+			changed: true,
+			want:    1360,
+			optoff:  46,
+		},
+		{
+			name:   "syn without mss option",
+			packet: "450000301c4640004006dea50a0000025db8d822d43201bb11223344000000007002faf031ac00000101040201030307",
+			mtu:    1400,
+		},
+		{
+			// MSS 1200 is already below the clamp
+			name:   "mss below clamp",
+			packet: "450000301c4640004006dea50a0000025db8d822d43301bb55667788000000007002faf0a6780000020404b001010402",
+			mtu:    1400,
+		},
+		{
+			name:   "mss equal to clamp",
+			packet: "450000301c4640004006dea50a0000025db8d822d43301bb55667788000000007002faf0a6780000020404b001010402",
+			mtu:    1240,
+		},
+		{
+			// The SYN with options, cut off 10 bytes short of its data offset
+			name:   "truncated options",
+			packet: "4500003cba194000400682a07f0000017f000001d024d12bdb640dcd00000000a002ffd7f65200000204ffd70402080ac16c",
+			mtu:    1400,
+		},
+		{
+			// An option whose length runs past the end of the options
+			name:   "option overruns header",
+			packet: "450000301c4640004006dea50a0000025db8d822d43501bb0badf00d000000007002faf0799f00000101020c05b40101",
+			mtu:    1400,
+		},
+		{
+			name:   "ack",
+			packet: "450000341c4640004006dea10a0000025db8d822d43101bb8e1f2a3c3c4d5e708010faf012e700000101080a0000000100000002",
+			mtu:    1400,
+		},
+		{
+			// The SYN with options as a later fragment
+			name:   "fragment",
+			packet: "4500003cba192001400682a07f0000017f000001d024d12bdb640dcd00000000a002ffd7f65200000204ffd70402080ac16c0dbd000000000103030a",
+			mtu:    1400,
+		},
+		{
+			// IPv6 SYN with MSS 1440, SACK permitted, and window scale
+			name:    "ipv6 syn",
+			packet:  "60000000001e064020010db80000000000000000000000022a0014504001080b000000000000200ed43201bb11223344000000007002faf096be0000020405a0040201030307",
+			mtu:     1400,
+			changed: true,
+			want:    1340,
+			optoff:  62,
+		},
+		{
+			// The same SYN behind a hop-by-hop options header
+			name:    "ipv6 syn with extension header",
+			packet:  "600000000026004020010db80000000000000000000000022a0014504001080b000000000000200e0600010400000000d43201bb11223344000000007002faf096be0000020405a0040201030307",
+			mtu:     1400,
+			changed: true,
+			want:    1340,
+			optoff:  70,
+		},
+		{
+			// MSS 1440 already fits an IPv6 MTU of 1500
+			name:   "ipv6 mss equal to clamp",
+			packet: "60000000001e064020010db80000000000000000000000022a0014504001080b000000000000200ed43201bb11223344000000007002faf096be0000020405a0040201030307",
+			mtu:    1500,
+		},
+		{
+			// The same SYN as the first fragment of a fragmented packet
+			name:   "ipv6 fragment",
+			packet: "6000000000262c4020010db80000000000000000000000022a0014504001080b000000000000200e0600000100001234d43201bb11223344000000007002faf096be0000020405a0040201030307",
+			mtu:    1400,
+		},
+		{
+			name:   "truncated tcp header",
+			packet: "4500003cba194000400682a07f0000017f000001d024d12bdb640dcd",
+			mtu:    1400,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := capture(t, test.packet)
+			orig := append([]byte(nil), packet...)
+
+			if changed := Clamp(packet, test.mtu); changed != test.changed {
+				t.Fatalf("Clamp returned %t, want %t", changed, test.changed)
+			}
+
+			if !test.changed {
+				if !bytes.Equal(packet, orig) {
+					t.Fatalf("packet changed without being clamped:\n got %x\nwant %x", packet, orig)
+				}
+				return
+			}
+
+			if got := binary.BigEndian.Uint16(packet[test.optoff:]); got != test.want {
+				t.Errorf("MSS is %d, want %d", got, test.want)
+			}
+			if !tcpchecksumok(packet) {
+				t.Errorf("TCP checksum is wrong after clamping: %x", packet)
+			}
+
+			// Nothing but the option value and the checksum may change
+			hdrlen := tcpoffset(packet)
+			for i := range packet {
+				if packet[i] != orig[i] && i != test.optoff && i != test.optoff+1 && i != hdrlen+16 && i != hdrlen+17 {
+					t.Errorf("byte %d changed from %#x to %#x", i, orig[i], packet[i])
+				}
+			}
+		})
+	}
+}
+
+// The incremental checksum update must match a recomputation at odd offsets too
+func TestRewriteOddOffset(t *testing.T) {
+	packet := capture(t, "4500003cba194000400682a07f0000017f000001d024d12bdb640dcd00000000a002ffd7f65200000204ffd70402080ac16c0dbd000000000103030a")
+	tcp := packet[20:]
+
+	// The window scale shift count, at an odd offset
+	rewrite(tcp, 16, 39, []byte{7})
+	if tcp[39] != 7 {
+		t.Fatalf("shift count is %d, want 7", tcp[39])
+	}
+	if !tcpchecksumok(packet) {
+		t.Errorf("TCP checksum is wrong after rewriting an odd offset: %x", packet)
+	}
+}
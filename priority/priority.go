@@ -0,0 +1,153 @@
+// Sorts packets into priority classes, and picks which class to send from next
+// Shared by the client and server
+package priority
+
+import (
+	"encoding/binary"
+	"log"
+
+	"github.com/joshperry/govpn/ipv6"
+	"github.com/micro/go-micro/v2/config"
+)
+
+// Priority classes of packets, highest first
+const (
+	High   = iota // Interactive: real-time DSCPs and configured ports
+	Normal        // Everything else
+	Low           // Bulk: lower effort DSCPs
+	Classes
+)
+
+// Sorts packets into priority classes
+// Every packet of a flow lands in the same class, so the classes never reorder a flow
+// Only what is the same for a whole flow decides: the DSCP, and the ports
+type Classifier struct {
+	ports map[uint16]bool // TCP and UDP ports whose traffic is interactive
+}
+
+// Make a classifier from the priority section of the config
+func NewClassifier() *Classifier {
+	c := &Classifier{ports: make(map[uint16]bool)}
+	var ports []int
+	config.Get("priority", "ports").Scan(&ports)
+	for _, port := range ports {
+		c.ports[uint16(port)] = true
+	}
+	return c
+}
+
+// Find the priority class of an IPv4 or IPv6 packet
+func (c *Classifier) Classify(packet []byte) int {
+	if len(packet) < 20 {
+		return Normal
+	}
+	v6 := packet[0]>>4 == 6
+
+	// The DSCP decides when the sender marked the packet
+	dscp := packet[1] >> 2
+	if v6 {
+		// From the traffic class straddling the first two bytes
+		dscp = (packet[0]<<4 | packet[1]>>4) >> 2
+	}
+	switch dscp {
+	case 46, 44, 32, 40, 48, 56, 34, 36, 38: // EF, VOICE-ADMIT, CS4-7, AF41-43
+		return High
+	case 8, 1: // CS1, LE
+		return Low
+	}
+
+	if len(c.ports) == 0 {
+		return Normal
+	}
+
+	// Either port of an unfragmented TCP or UDP packet, past any IPv6 extension headers
+	// Fragments stay normal, since only the first of them carries the ports
+	proto, hdrlen := int(packet[9]), (int(packet[0])&0x0F)*4
+	fragmented := packet[6]&0x3F != 0 || packet[7] != 0 // MF flag or fragment offset
+	if v6 {
+		proto, hdrlen, fragmented = ipv6.Transport(packet)
+	}
+	if (proto == 6 || proto == 17) && !fragmented && len(packet) >= hdrlen+4 {
+		if c.ports[binary.BigEndian.Uint16(packet[hdrlen:])] || c.ports[binary.BigEndian.Uint16(packet[hdrlen+2:])] {
+			return High
+		}
+	}
+
+	return Normal
+}
+
+// Picks which priority class to send from next
+// Strict priority always serves the highest class with packets waiting
+// Weighted is deficit round robin, each class sending its weight in MTU sized quanta of bytes per round
+// Owned by a single goroutine, so no locking
+type Scheduler struct {
+	strict  bool
+	quantum [Classes]int
+	deficit [Classes]int
+	next    int  // The class being served this round
+	fresh   bool // The class hasn't had its quantum this round
+}
+
+// Make a scheduler from the priority section of the config
+func NewScheduler(mtu int) *Scheduler {
+	s := &Scheduler{fresh: true}
+
+	switch mode := config.Get("priority", "scheduler").String("weighted"); mode {
+	case "strict":
+		s.strict = true
+	case "weighted":
+	default:
+		log.Printf("priority: unknown scheduler %q, using weighted", mode)
+	}
+
+	var weights []int
+	if config.Get("priority", "weights").Scan(&weights); len(weights) == 0 {
+		weights = []int{4, 2, 1}
+	}
+	for class := range s.quantum {
+		weight := 1
+		if class < len(weights) && weights[class] > 0 {
+			weight = weights[class]
+		}
+		s.quantum[class] = weight * mtu
+	}
+
+	return s
+}
+
+// Pick the class to send the head packet of, given the length of each class's head packet or zero when it is empty
+// Returns -1 when every class is empty
+func (s *Scheduler) Pick(heads [Classes]int) int {
+	if s.strict {
+		for class, head := range heads {
+			if head != 0 {
+				return class
+			}
+		}
+		return -1
+	}
+
+	for empty := 0; empty < Classes; {
+		class := s.next
+		if heads[class] == 0 {
+			// Empty classes don't bank their deficit
+			s.deficit[class] = 0
+			empty++
+		} else {
+			empty = 0
+			if s.fresh {
+				s.deficit[class] += s.quantum[class]
+				s.fresh = false
+			}
+			if s.deficit[class] >= heads[class] {
+				s.deficit[class] -= heads[class]
+				return class
+			}
+		}
+
+		s.next = (class + 1) % Classes
+		s.fresh = true
+	}
+
+	return -1
+}
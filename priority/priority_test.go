@@ -0,0 +1,66 @@
+package priority
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// An IPv4 TCP packet of n bytes between ports src and dst
+func packet4(n int, src uint16, dst uint16) []byte {
+	packet := make([]byte, n)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(n))
+	packet[9] = 6
+	binary.BigEndian.PutUint16(packet[20:], src)
+	binary.BigEndian.PutUint16(packet[22:], dst)
+	return packet
+}
+
+// An IPv6 TCP packet of n bytes between ports src and dst, behind a destination options header
+func packet6(n int, src uint16, dst uint16) []byte {
+	packet := make([]byte, n)
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:], uint16(n-40))
+	packet[6] = 60
+	packet[40] = 6
+	binary.BigEndian.PutUint16(packet[48:], src)
+	binary.BigEndian.PutUint16(packet[50:], dst)
+	return packet
+}
+
+// Every packet of a flow gets the same class whatever its size
+func TestClassifyPerFlow(t *testing.T) {
+	c := &Classifier{ports: map[uint16]bool{22: true}}
+
+	for _, n := range []int{40, 64, 1400} {
+		if class := c.Classify(packet4(n, 40000, 443)); class != Normal {
+			t.Errorf("%d byte https packet is class %d, want normal", n, class)
+		}
+		if class := c.Classify(packet4(n, 40000, 22)); class != High {
+			t.Errorf("%d byte ssh packet is class %d, want high", n, class)
+		}
+		if class := c.Classify(packet6(n+20, 22, 40000)); class != High {
+			t.Errorf("%d byte ipv6 ssh packet is class %d, want high", n+20, class)
+		}
+	}
+
+	// Marked packets go by their DSCP
+	marked := packet4(1400, 40000, 443)
+	marked[1] = 46 << 2
+	if class := c.Classify(marked); class != High {
+		t.Errorf("EF packet is class %d, want high", class)
+	}
+	marked[1] = 8 << 2
+	if class := c.Classify(marked); class != Low {
+		t.Errorf("CS1 packet is class %d, want low", class)
+	}
+
+	// Both fragments of a packet on an interactive port stay together
+	first := packet4(1400, 40000, 22)
+	first[6] = 0x20
+	later := packet4(200, 22, 22)
+	binary.BigEndian.PutUint16(later[6:], 1376/8)
+	if c.Classify(first) != c.Classify(later) {
+		t.Error("fragments of a packet were classed apart")
+	}
+}
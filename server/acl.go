@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/joshperry/govpn/ipv6"
+	"github.com/micro/go-micro/v2/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The direction of a packet relative to the client
+type acldir int
+
+const (
+	_      acldir = iota
+	aclOut        // From the client, seen in connrx
+	aclIn         // To the client, seen in the router
+)
+
+// What to do with a packet matching a rule
+type aclaction int
+
+const (
+	aclAccept aclaction = iota
+	aclDrop
+	aclReject // Drop and answer with a TCP RST or ICMP prohibited
+)
+
+// A packet filter rule as written in the config
+type ACLRule struct {
+	Name      string `json:"name"`      // Label for the rule's hit counter, defaults to its position
+	Identity  string `json:"identity"`  // Client identity the rule applies to, empty for any
+	Group     string `json:"group"`     // Client group the rule applies to, empty for any
+	Direction string `json:"direction"` // out from the client (default), or in to it
+	Network   string `json:"network"`   // CIDR of the remote end, empty for any
+	Protocol  string `json:"protocol"`  // tcp, udp, icmp, icmpv6, a protocol number, or empty for any
+	Ports     string `json:"ports"`     // Destination port or lo-hi range, empty for any
+	Action    string `json:"action"`    // accept, drop or reject
+}
+
+// A rule compiled for evaluation in the data path
+type aclrule struct {
+	identity string
+	group    string
+	dir      acldir
+	network  *net.IPNet // nil for any
+	proto    int        // -1 for any
+	portlo   int        // -1 for any
+	porthi   int
+	action   aclaction
+	name     string // label of the hit counter
+	hits     prometheus.Counter
+}
+
+// An immutable compiled rule set, swapped whole on reload
+// The first matching rule decides, the default action applies when none match
+type aclset struct {
+	rules   []aclrule
+	def     aclaction
+	defhits prometheus.Counter
+}
+
+// Evaluates packets against the current rule set
+// Shared by all of the pumps and routers, reloads swap the set atomically
+type aclengine struct {
+	set atomic.Value // *aclset
+}
+
+// Parse an action name
+func parseaction(name string) (aclaction, error) {
+	switch strings.ToLower(name) {
+	case "accept", "":
+		return aclAccept, nil
+	case "drop":
+		return aclDrop, nil
+	case "reject":
+		return aclReject, nil
+	}
+	return aclAccept, fmt.Errorf("unknown action %q", name)
+}
+
+// Compile the rules in the acl section of the config
+func compileacl() (*aclset, error) {
+	var rules []ACLRule
+	if err := config.Get("acl", "rules").Scan(&rules); nil != err {
+		return nil, err
+	}
+
+	def, err := parseaction(config.Get("acl", "default").String("accept"))
+	if nil != err {
+		return nil, fmt.Errorf("default: %s", err)
+	}
+
+	set := &aclset{def: def, defhits: acl_hitsmetric.WithLabelValues("default")}
+	for i, rule := range rules {
+		compiled := aclrule{
+			identity: rule.Identity,
+			group:    rule.Group,
+			dir:      aclOut,
+			proto:    -1,
+			portlo:   -1,
+		}
+
+		name := rule.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		fail := func(err error) (*aclset, error) {
+			return nil, fmt.Errorf("rule %s: %s", name, err)
+		}
+
+		switch strings.ToLower(rule.Direction) {
+		case "out", "":
+		case "in":
+			compiled.dir = aclIn
+		default:
+			return fail(fmt.Errorf("unknown direction %q", rule.Direction))
+		}
+
+		if rule.Network != "" {
+			if _, network, err := net.ParseCIDR(rule.Network); nil != err {
+				return fail(err)
+			} else {
+				compiled.network = network
+			}
+		}
+
+		switch strings.ToLower(rule.Protocol) {
+		case "", "any":
+		case "icmp":
+			compiled.proto = 1
+		case "icmpv6":
+			compiled.proto = 58
+		case "tcp":
+			compiled.proto = 6
+		case "udp":
+			compiled.proto = 17
+		default:
+			if proto, err := strconv.ParseUint(rule.Protocol, 10, 8); nil != err {
+				return fail(fmt.Errorf("unknown protocol %q", rule.Protocol))
+			} else {
+				compiled.proto = int(proto)
+			}
+		}
+
+		if rule.Ports != "" {
+			lo, hi := rule.Ports, rule.Ports
+			if i := strings.Index(rule.Ports, "-"); i >= 0 {
+				lo, hi = rule.Ports[:i], rule.Ports[i+1:]
+			}
+			portlo, errlo := strconv.ParseUint(lo, 10, 16)
+			porthi, errhi := strconv.ParseUint(hi, 10, 16)
+			if nil != errlo || nil != errhi || portlo > porthi {
+				return fail(fmt.Errorf("bad port range %q", rule.Ports))
+			}
+			compiled.portlo, compiled.porthi = int(portlo), int(porthi)
+		}
+
+		if compiled.action, err = parseaction(rule.Action); nil != err {
+			return fail(err)
+		}
+
+		compiled.name = name
+		compiled.hits = acl_hitsmetric.WithLabelValues(name)
+		set.rules = append(set.rules, compiled)
+	}
+
+	return set, nil
+}
+
+// Make an engine with the configured rule set, or an empty one that accepts everything if it doesn't compile
+func newaclengine() *aclengine {
+	e := &aclengine{}
+	if set, err := compileacl(); nil != err {
+		log.Printf("server: acl: failed compiling rules, accepting all: %s", err)
+		e.set.Store(&aclset{})
+	} else {
+		log.Printf("server: acl: loaded %d rules", len(set.rules))
+		e.set.Store(set)
+	}
+	return e
+}
+
+// Recompile the rule set whenever the acl config changes
+// A set that fails to compile is logged and the current one kept
+// Exits when the config watcher fails
+func aclwatch(e *aclengine) {
+	watcher, err := config.Watch("acl")
+	if nil != err {
+		log.Printf("server: acl(term): unable to watch config: %s", err)
+		return
+	}
+	defer watcher.Stop()
+
+	for {
+		if _, err := watcher.Next(); nil != err {
+			log.Printf("server: acl(term): config watch failed: %s", err)
+			return
+		}
+
+		if set, err := compileacl(); nil != err {
+			log.Printf("server: acl: keeping current rules, reload failed: %s", err)
+			acl_reloadmetric.WithLabelValues("failed").Inc()
+		} else {
+			old := e.set.Load().(*aclset)
+			e.set.Store(set)
+			old.forget(set)
+			log.Printf("server: acl: reloaded %d rules", len(set.rules))
+			acl_reloadmetric.WithLabelValues("loaded").Inc()
+		}
+	}
+}
+
+// Delete the hit counters of rules that aren't in the next set
+func (set *aclset) forget(next *aclset) {
+	kept := make(map[string]bool)
+	for _, rule := range next.rules {
+		kept[rule.name] = true
+	}
+	for _, rule := range set.rules {
+		if !kept[rule.name] {
+			acl_hitsmetric.DeleteLabelValues(rule.name)
+		}
+	}
+}
+
+// Decide what to do with an IPv4 or IPv6 packet travelling in dir for client
+func (e *aclengine) eval(client *Client, dir acldir, packet []byte) aclaction {
+	set := e.set.Load().(*aclset)
+	if len(set.rules) == 0 {
+		return set.def
+	}
+
+	// The remote end's address
+	remote := dstaddr(packet)
+	if dir == aclIn {
+		remote = srcaddr(packet)
+	}
+
+	// The protocol, and the destination port unless this is a later fragment or not TCP or UDP
+	// IPv6 packets whose extension headers can't be walked are dropped, rather than risk them slipping past a rule
+	proto, hdrlen := int(packet[9]), (int(packet[0])&0x0F)*4
+	if packet[0]>>4 == 6 {
+		if proto, hdrlen, _ = ipv6.Transport(packet); proto < 0 {
+			set.defhits.Inc()
+			return aclDrop
+		}
+	} else if packet[6]&0x1F != 0 || packet[7] != 0 {
+		hdrlen = -1
+	}
+	port := -1
+	if (proto == 6 || proto == 17) && hdrlen >= 0 && len(packet) >= hdrlen+4 {
+		port = int(binary.BigEndian.Uint16(packet[hdrlen+2:]))
+	}
+
+	for i := range set.rules {
+		rule := &set.rules[i]
+		if rule.dir != dir ||
+			(rule.identity != "" && rule.identity != client.name) ||
+			(rule.group != "" && !client.ingroup(rule.group)) ||
+			(rule.proto >= 0 && rule.proto != proto) ||
+			(rule.network != nil && !rule.network.Contains(remote)) ||
+			(rule.portlo >= 0 && (port < rule.portlo || port > rule.porthi)) {
+			continue
+		}
+
+		rule.hits.Inc()
+		return rule.action
+	}
+
+	set.defhits.Inc()
+	return set.def
+}
+
+// Filter a message travelling in dir for client
+// Returns false if the packet was accepted, otherwise it was refused through send when rejected and msg returned to the pool
+func (e *aclengine) filter(client *Client, dir acldir, msg *message, serverip uint32, send func(*message), limiter *replylimiter, bufpool *sync.Pool) bool {
+	action := e.eval(client, dir, msg.packet)
+	if action == aclAccept {
+		return false
+	}
+
+	reply := "none"
+	if action == aclReject {
+		reply = refuse(msg.packet, icmpProhibited, serverip, send, limiter, bufpool)
+	}
+
+	direction := "out"
+	if dir == aclIn {
+		direction = "in"
+	}
+	acl_actionmetric.WithLabelValues(direction, reply).Inc()
+
+	bufpool.Put(msg)
+	return true
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/v2/config"
+)
+
+// Asks contrack to disconnect the session with id, or every session of the identity name when id is zero, or every session when all is set
+// The number of sessions disconnected is sent on resp
+type DisconnectReq struct {
+	id     uint64
+	name   string
+	all    bool // every open session, when draining
+	reason string
+	resp   chan<- int
+}
+
+// An identity refused connections until the block expires
+type Block struct {
+	Name    string    `json:"name"`
+	Reason  string    `json:"reason"`
+	Expires time.Time `json:"expires"`
+}
+
+// Identities that are temporarily refused connections
+// Safe for use by the client handlers and the admin API
+type blocklist struct {
+	sync.Mutex
+	blocks map[string]Block
+}
+
+func newblocklist() *blocklist {
+	return &blocklist{blocks: make(map[string]Block)}
+}
+
+// Check if the identity name is blocked, and why
+func (b *blocklist) blocked(name string) (Block, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	block, ok := b.blocks[name]
+	if ok && time.Now().After(block.Expires) {
+		delete(b.blocks, name)
+		return block, false
+	}
+	return block, ok
+}
+
+// Block the identity name for duration, replacing any block it already has
+func (b *blocklist) add(name string, reason string, duration time.Duration) Block {
+	b.Lock()
+	defer b.Unlock()
+
+	block := Block{Name: name, Reason: reason, Expires: time.Now().Add(duration)}
+	b.blocks[name] = block
+	return block
+}
+
+// Lift the block on the identity name, returning false if it had none
+func (b *blocklist) remove(name string) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	_, ok := b.blocks[name]
+	delete(b.blocks, name)
+	return ok
+}
+
+// Report the blocks that haven't expired, by name
+func (b *blocklist) report() []Block {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	var blocks []Block
+	for name, block := range b.blocks {
+		if now.After(block.Expires) {
+			delete(b.blocks, name)
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Name < blocks[j].Name })
+	return blocks
+}
+
+// Whether the server is draining, refusing new sessions so clients reconnect to the other servers behind the load balancer
+// Striped connections may still join the sessions already here
+type drainstate struct {
+	sync.Mutex
+	on     bool
+	reason string
+}
+
+// Check if the server is draining, and why
+func (d *drainstate) draining() (string, bool) {
+	d.Lock()
+	defer d.Unlock()
+	return d.reason, d.on
+}
+
+// Start or stop draining
+func (d *drainstate) set(on bool, reason string) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.on, d.reason = on, reason
+	if on {
+		admin_drainingmetric.Set(1)
+	} else {
+		admin_drainingmetric.Set(0)
+	}
+}
+
+// A page of the session list
+type SessionPage struct {
+	Total    int         `json:"total"` // sessions matching the filters
+	Offset   int         `json:"offset"`
+	Sessions Connections `json:"sessions"`
+}
+
+// Admin API for the sessions of connected clients and the block list
+// Sessions are listed through contrack's report, and disconnected through contrack so the routes and addresses are cleaned up as usual
+type adminapi struct {
+	reportchan     chan<- chan<- Connections
+	disconnectchan chan<- DisconnectReq
+	blocks         *blocklist
+	drain          *drainstate
+	ipam           IPAM
+	limits         *ratelimits
+}
+
+// Get the sessions from contrack, oldest first
+func (a *adminapi) sessions() Connections {
+	respchan := make(chan Connections)
+	a.reportchan <- respchan
+	cons := <-respchan
+
+	sort.Slice(cons, func(i, j int) bool {
+		if !cons[i].Time.Equal(cons[j].Time) {
+			return cons[i].Time.Before(cons[j].Time)
+		}
+		return cons[i].ID < cons[j].ID
+	})
+	return cons
+}
+
+// Disconnect the session with id, or every session of name when id is zero
+func (a *adminapi) disconnect(id uint64, name string, reason string) int {
+	respchan := make(chan int)
+	a.disconnectchan <- DisconnectReq{id: id, name: name, reason: reason, resp: respchan}
+	return <-respchan
+}
+
+// Disconnect every open session
+func (a *adminapi) disconnectall(reason string) int {
+	respchan := make(chan int)
+	a.disconnectchan <- DisconnectReq{all: true, reason: reason, resp: respchan}
+	return <-respchan
+}
+
+// Check if a session matches the list filters in query
+// name, group, pool, and ip match exactly, pending is true or false
+func sessionmatches(con Connection, query map[string][]string) bool {
+	get := func(key string) string {
+		if values := query[key]; len(values) != 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	if name := get("name"); name != "" && con.Name != name {
+		return false
+	}
+	if pool := get("pool"); pool != "" && con.Pool != pool {
+		return false
+	}
+	if ip := get("ip"); ip != "" && con.IP != ip && con.IP6 != ip {
+		return false
+	}
+	if pending := get("pending"); pending != "" && strconv.FormatBool(con.Pending) != pending {
+		return false
+	}
+	if group := get("group"); group != "" {
+		for _, other := range con.Groups {
+			if other == group {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Write v as a json response
+func writejson(w http.ResponseWriter, v interface{}) {
+	if respbuf, err := json.Marshal(v); nil != err {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(respbuf)
+	}
+}
+
+// Read the optional json body of a disconnect or block request
+func readreason(req *http.Request, body interface{}) error {
+	if req.ContentLength == 0 {
+		return nil
+	}
+	return json.NewDecoder(req.Body).Decode(body)
+}
+
+// Admin API handler
+// GET /admin/sessions lists sessions, filtered by the name, group, pool, ip, and pending query parameters, a page of limit (100) from offset (0)
+// GET /admin/sessions/<id> shows a session
+// DELETE /admin/sessions/<id> disconnects a session, and DELETE /admin/identities/<name>/sessions every session of an identity, with an optional json body like {"reason": "..."}
+// GET /admin/blocks lists the blocked identities
+// PUT /admin/blocks/<name> with a json body like {"reason": "...", "seconds": 3600} blocks an identity and disconnects its sessions, DELETE lifts the block
+// GET /admin/leases lists the address leases
+// PUT /admin/reservations/<name> with a json body like {"ip": "192.168.0.10"} reserves an address for an identity
+// POST /admin/reload reloads the config from its sources
+// GET /admin/drain shows whether the server is draining, PUT with a json body like {"reason": "...", "kick": true} starts draining, disconnecting every session when kick is set, DELETE stops
+// /admin/ratelimits is handled by the rate limits
+func (a *adminapi) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin"), "/"), "/")
+
+	switch {
+	case path[0] == "ratelimits":
+		a.limits.ServeHTTP(w, req)
+
+	case req.Method == http.MethodGet && len(path) == 1 && path[0] == "sessions":
+		query := req.URL.Query()
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+		if offset < 0 {
+			offset = 0
+		}
+
+		var matched Connections
+		for _, con := range a.sessions() {
+			if sessionmatches(con, query) {
+				matched = append(matched, con)
+			}
+		}
+
+		page := SessionPage{Total: len(matched), Offset: offset, Sessions: Connections{}}
+		if offset < len(matched) {
+			end := offset + limit
+			if end > len(matched) {
+				end = len(matched)
+			}
+			page.Sessions = matched[offset:end]
+		}
+		writejson(w, page)
+
+	case len(path) == 2 && path[0] == "sessions":
+		id, err := strconv.ParseUint(path[1], 0, 64)
+		if err != nil || id == 0 {
+			http.Error(w, "bad session id", http.StatusBadRequest)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			for _, con := range a.sessions() {
+				if con.ID == fmt.Sprintf("%#x", id) {
+					writejson(w, con)
+					return
+				}
+			}
+			http.Error(w, "no such session", http.StatusNotFound)
+
+		case http.MethodDelete:
+			var body struct {
+				Reason string `json:"reason"`
+			}
+			if err := readreason(req, &body); nil != err {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if body.Reason == "" {
+				body.Reason = "disconnected by an administrator"
+			}
+
+			if a.disconnect(id, "", body.Reason) == 0 {
+				http.Error(w, "no such session", http.StatusNotFound)
+				return
+			}
+			log.Printf("server: admin: disconnected session %#x: %s", id, body.Reason)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	case req.Method == http.MethodDelete && len(path) == 3 && path[0] == "identities" && path[2] == "sessions":
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if err := readreason(req, &body); nil != err {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Reason == "" {
+			body.Reason = "disconnected by an administrator"
+		}
+
+		count := a.disconnect(0, path[1], body.Reason)
+		log.Printf("server: admin: disconnected %d sessions of %s: %s", count, path[1], body.Reason)
+		writejson(w, map[string]int{"disconnected": count})
+
+	case req.Method == http.MethodGet && len(path) == 1 && path[0] == "blocks":
+		blocks := a.blocks.report()
+		if blocks == nil {
+			blocks = []Block{}
+		}
+		writejson(w, blocks)
+
+	case req.Method == http.MethodPut && len(path) == 2 && path[0] == "blocks":
+		var body struct {
+			Reason  string `json:"reason"`
+			Seconds int    `json:"seconds"`
+		}
+		if err := readreason(req, &body); nil != err {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Seconds <= 0 {
+			http.Error(w, "seconds must be positive", http.StatusBadRequest)
+			return
+		}
+		if body.Reason == "" {
+			body.Reason = "blocked by an administrator"
+		}
+
+		// Block before disconnecting so the sessions can't reconnect in between
+		block := a.blocks.add(path[1], body.Reason, time.Duration(body.Seconds)*time.Second)
+		count := a.disconnect(0, path[1], body.Reason)
+		log.Printf("server: admin: blocked %s until %s, disconnecting %d sessions: %s", path[1], block.Expires.UTC().Format(time.RFC3339), count, body.Reason)
+		writejson(w, block)
+
+	case req.Method == http.MethodDelete && len(path) == 2 && path[0] == "blocks":
+		if !a.blocks.remove(path[1]) {
+			http.Error(w, "not blocked", http.StatusNotFound)
+			return
+		}
+		log.Printf("server: admin: lifted block on %s", path[1])
+		w.WriteHeader(http.StatusNoContent)
+
+	case req.Method == http.MethodGet && len(path) == 1 && path[0] == "leases":
+		leases := a.ipam.List()
+		if leases == nil {
+			leases = Leases{}
+		}
+		writejson(w, leases)
+
+	case req.Method == http.MethodPut && len(path) == 2 && path[0] == "reservations":
+		var body struct {
+			IP string `json:"ip"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); nil != err {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := a.ipam.Reserve(path[1], net.ParseIP(body.IP)); nil != err {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		log.Printf("server: admin: reserved %s for %s", body.IP, path[1])
+		w.WriteHeader(http.StatusNoContent)
+
+	case req.Method == http.MethodPost && len(path) == 1 && path[0] == "reload":
+		// Watchers like the acl's pick up the changes, everything else reads the config as it goes
+		if err := config.Sync(); nil != err {
+			log.Printf("server: admin: error reloading config: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Print("server: admin: reloaded config")
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(path) == 1 && path[0] == "drain":
+		switch req.Method {
+		case http.MethodGet:
+			reason, on := a.drain.draining()
+			writejson(w, map[string]interface{}{"draining": on, "reason": reason})
+
+		case http.MethodPut:
+			var body struct {
+				Reason string `json:"reason"`
+				Kick   bool   `json:"kick"`
+			}
+			if err := readreason(req, &body); nil != err {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if body.Reason == "" {
+				body.Reason = "server draining"
+			}
+
+			// Drain before disconnecting so the sessions reconnect elsewhere
+			a.drain.set(true, body.Reason)
+			var count int
+			if body.Kick {
+				count = a.disconnectall(body.Reason)
+			}
+			log.Printf("server: admin: draining, disconnected %d sessions: %s", count, body.Reason)
+			writejson(w, map[string]int{"disconnected": count})
+
+		case http.MethodDelete:
+			a.drain.set(false, "")
+			log.Print("server: admin: stopped draining")
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// Serve the admin API at addr over TLS, refusing clients without a certificate from admin.ca
+// This is the only place the admin API is served, it is never on the unauthenticated metrics server
+// When admin.identities is set only those certificate common names are let in
+// The server's tls.cert and tls.key are used where the admin ones aren't set, tls.ca only along with admin.identities
+func adminlisten(addr string, admin *adminapi) {
+	cer, err := tls.LoadX509KeyPair(
+		config.Get("admin", "cert").String(config.Get("tls", "cert").String("cert.pem")),
+		config.Get("admin", "key").String(config.Get("tls", "key").String("key.pem")),
+	)
+	if err != nil {
+		log.Fatalf("server: admin: failed to load PKI material: %s", err)
+	}
+
+	var identities []string
+	config.Get("admin", "identities").Scan(&identities)
+
+	// Every client the tunnel CA signed would be an operator, unless the admin API has its own CA or a list of operators
+	tunnelca := config.Get("tls", "ca").String("ca.pem")
+	ca := config.Get("admin", "ca").String("")
+	if (ca == "" || ca == tunnelca) && len(identities) == 0 {
+		log.Print("server: admin: not serving the admin API without admin.ca separate from tls.ca, or admin.identities")
+		return
+	}
+	if ca == "" {
+		log.Printf("server: admin: admin.ca unset, operators must be in admin.identities and signed by the tunnel CA %s", tunnelca)
+		ca = tunnelca
+	}
+
+	certpool := x509.NewCertPool()
+	pem, err := ioutil.ReadFile(ca)
+	if err != nil {
+		log.Fatalf("server: admin: failed to read client certificate authority: %s", err)
+	}
+	if !certpool.AppendCertsFromPEM(pem) {
+		log.Fatal("server: admin: failed to parse client certificate authority")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/", func(w http.ResponseWriter, req *http.Request) {
+		operator := req.TLS.PeerCertificates[0].Subject.CommonName
+		if len(identities) != 0 {
+			allowed := false
+			for _, identity := range identities {
+				allowed = allowed || identity == operator
+			}
+			if !allowed {
+				log.Printf("server: admin: refused %s from %s", operator, req.RemoteAddr)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		if req.Method != http.MethodGet {
+			log.Printf("server: admin: %s %s by %s", req.Method, req.URL.Path, operator)
+		}
+		admin.ServeHTTP(w, req)
+	})
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cer},
+			MinVersion:   tls.VersionTLS12,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    certpool,
+		},
+	}
+
+	log.Printf("server: admin: https listen on %s", addr)
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
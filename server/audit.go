@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/syslog"
+	"os"
+	"time"
+
+	"github.com/micro/go-micro/v2/config"
+)
+
+// A line of the audit log, for each client connect and disconnect
+// Disconnects summarize the session: how long it lasted, the traffic it moved, and why it ended
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"` // connect or disconnect
+	Name     string    `json:"name"`
+	Groups   []string  `json:"groups,omitempty"`
+	Session  string    `json:"session"` // the session id, as in the admin API
+	PublicIP string    `json:"publicip"`
+	IP       string    `json:"ip"`
+	IP6      string    `json:"ip6,omitempty"`
+	Pool     string    `json:"pool"`
+
+	// Disconnects only
+	Connected   *time.Time `json:"connected,omitempty"`
+	Duration    float64    `json:"duration,omitempty"` // seconds
+	UpPackets   uint64     `json:"uppackets,omitempty"`
+	UpBytes     uint64     `json:"upbytes,omitempty"`
+	DownPackets uint64     `json:"downpackets,omitempty"`
+	DownBytes   uint64     `json:"downbytes,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+}
+
+// Make the audit entry for a client state transition
+func auditentry(state ClientState) AuditEntry {
+	client := state.client
+	entry := AuditEntry{
+		Time:     state.happened.UTC(),
+		Event:    "connect",
+		Name:     client.name,
+		Groups:   client.groups,
+		Session:  fmt.Sprintf("%#x", client.id),
+		PublicIP: client.publicip.String(),
+		IP:       client.ip.String(),
+		IP6:      ip6string(client.ip6),
+		Pool:     client.pool.name,
+	}
+
+	if state.transition == Disconnect {
+		traffic := client.traffic.snapshot()
+		connected := client.connected.UTC()
+
+		entry.Event = "disconnect"
+		entry.Connected = &connected
+		entry.Duration = state.happened.Sub(client.connected).Seconds()
+		entry.UpPackets = traffic.uppackets
+		entry.UpBytes = traffic.upbytes
+		entry.DownPackets = traffic.downpackets
+		entry.DownBytes = traffic.downbytes
+		entry.Reason = state.reason
+	}
+	return entry
+}
+
+// An audit log file that is rotated when it would grow past maxsize
+// The rotated files are path.1, the newest, to path.<keep>, and older ones are removed
+type auditfile struct {
+	path    string
+	maxsize int64
+	keep    int
+	file    *os.File
+	size    int64
+}
+
+// Open the audit log at path for appending, creating it if it doesn't exist
+func openauditfile(path string, maxsize int64, keep int) (*auditfile, error) {
+	a := &auditfile{path: path, maxsize: maxsize, keep: keep}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditfile) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file, a.size = file, info.Size()
+	return nil
+}
+
+// Shift the rotated files along, dropping the oldest, and start a new log
+// Without rotated files to keep, the log is truncated instead
+// The old log stays open until the new one is, so a failed rotation leaves the log being written where it was
+func (a *auditfile) rotate() error {
+	if a.keep <= 0 {
+		if err := a.file.Truncate(0); err != nil {
+			return err
+		}
+		a.size = 0
+		return nil
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", a.path, a.keep))
+	for i := a.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return err
+	}
+
+	old := a.file
+	if err := a.open(); err != nil {
+		// Put the log back so the old handle keeps writing it
+		os.Rename(a.path+".1", a.path)
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// Append a line to the log, synced to disk before returning
+// The log is rotated first when the line would take it past maxsize, unless it is empty
+// When rotation fails the line is still written, and rotation tried again with the next one
+func (a *auditfile) write(line []byte) error {
+	if a.size != 0 && a.size+int64(len(line)) > a.maxsize {
+		if err := a.rotate(); err != nil {
+			log.Printf("server: audit: error rotating %s, still writing to it: %s", a.path, err)
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// Writes an audit log entry for every client state transition, to a file, syslog, or both
+// Entries are queued for a writer, and a full queue holds up taking more client state until the writer catches up
+// With audit.drop set, entries that don't fit the queue are dropped and counted instead
+// Does nothing when neither audit.file nor audit.syslog is set
+// Exits when the state channel is closed
+func audit(subchan chan<- ClientStateSub) {
+	path := config.Get("audit", "file").String("")
+	tosyslog := config.Get("audit", "syslog").Bool(false)
+	if path == "" && !tosyslog {
+		return
+	}
+
+	var file *auditfile
+	if path != "" {
+		var err error
+		maxsize := int64(config.Get("audit", "maxsize").Int(100)) * 1024 * 1024
+		if file, err = openauditfile(path, maxsize, config.Get("audit", "keep").Int(5)); err != nil {
+			log.Fatalf("server: audit: error opening audit log %s: %s", path, err)
+		}
+		log.Printf("server: audit: writing to %s", path)
+	}
+
+	var logger *syslog.Writer
+	if tosyslog {
+		var err error
+		if logger, err = syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, config.Get("audit", "tag").String("govpn")); err != nil {
+			log.Fatalf("server: audit: error connecting to syslog: %s", err)
+		}
+		log.Print("server: audit: writing to syslog")
+	}
+
+	written := audit_entriesmetric.WithLabelValues("written")
+	failed := audit_entriesmetric.WithLabelValues("failed")
+	dropped := audit_entriesmetric.WithLabelValues("dropped")
+	drop := config.Get("audit", "drop").Bool(false)
+
+	// The writer, exits when the queue is closed
+	queue := make(chan AuditEntry, config.Get("audit", "queue").Int(4096))
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for entry := range queue {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				log.Printf("server: audit: error encoding entry: %s", err)
+				failed.Inc()
+				continue
+			}
+
+			ok := true
+			if logger != nil {
+				if err := logger.Info(string(line)); err != nil {
+					log.Printf("server: audit: error writing to syslog: %s", err)
+					ok = false
+				}
+			}
+			if file != nil {
+				if err := file.write(append(line, '\n')); err != nil {
+					log.Printf("server: audit: error writing to %s: %s", path, err)
+					ok = false
+				}
+			}
+
+			if ok {
+				written.Inc()
+			} else {
+				failed.Inc()
+			}
+		}
+	}()
+
+	// Channel to receive client state
+	statechan := make(chan ClientState)
+
+	// Subscribe to client state stream
+	subchan <- ClientStateSub{name: "audit", subchan: statechan}
+
+	log.Print("server: audit: starting main loop")
+	for state := range statechan {
+		// The traffic counts are taken now, as the client's pumps stop
+		entry := auditentry(state)
+
+		if !drop {
+			queue <- entry
+			continue
+		}
+
+		select {
+		case queue <- entry:
+		default:
+			log.Printf("server: audit: queue full, dropped %s of %s-%s", entry.Event, entry.Name, entry.Session)
+			dropped.Inc()
+		}
+	}
+
+	// Let the writer finish what's queued
+	close(queue)
+	<-done
+	if file != nil {
+		file.file.Close()
+	}
+	if logger != nil {
+		logger.Close()
+	}
+	log.Print("server: audit(term): statechan closed")
+}
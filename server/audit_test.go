@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Entries keep going to the log when it can't be rotated, and rotation resumes once it can
+func TestAuditRotateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// A non-empty directory in the way of the rotated log
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := openauditfile(path, 64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.file.Close()
+
+	line := strings.Repeat("x", 39) + "\n"
+	for i := 0; i < 4; i++ {
+		if err := file.write([]byte(line)); err != nil {
+			t.Fatalf("write %d: %s", i, err)
+		}
+	}
+	if buf, err := ioutil.ReadFile(path); err != nil || string(buf) != strings.Repeat(line, 4) {
+		t.Fatalf("log holds %q, %v, want all 4 lines", buf, err)
+	}
+
+	// Out of the way, the next write rotates
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.write([]byte(line)); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := ioutil.ReadFile(path + ".1"); err != nil || string(buf) != strings.Repeat(line, 4) {
+		t.Errorf("rotated log holds %q, %v, want the first 4 lines", buf, err)
+	}
+	if buf, err := ioutil.ReadFile(path); err != nil || string(buf) != line {
+		t.Errorf("log holds %q, %v, want the last line", buf, err)
+	}
+}
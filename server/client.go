@@ -6,7 +6,10 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/micro/go-micro/v2/config"
 )
 
 // An "enum" of the transition state
@@ -27,22 +30,69 @@ type ClientState struct {
 	happened   time.Time
 	transition Transition
 	client     *Client
+	reason     string // why the client disconnected, for Disconnect
 }
 
 // Defines the state for an authenticated client connection
 // Birthed in the client connection handler `func (s *Service) serve(/**/)` and used in messages sent for data route updates and ip address reaping
 type Client struct {
+	traffic traffic // kept first for the 64-bit alignment of its atomic counters
+
 	ip           net.IP // client tunnel ip
+	ip6          net.IP // client tunnel IPv6 address, nil when the tunnel is IPv4 only
+	sticky       bool   // the client got the address its identity had last time
+	pool         *pool  // the address pool the client's ip is from
 	intip        uint32 // client tunnel ip as an integer
 	id           uint64 // A unique identifier for this client connection
 	connected    time.Time
 	disconnected time.Time
-	publicip     net.IP // client public ip
-	name         string // name of the authenticated client
-	// A goroutine in the client connection handler reads packets from this channel and then writes them out the client tls socket
-	// A goroutine in the router reads packets from the tun interface and writes any destined for this client ip, to this channel
-	tx      chan *message
-	control chan string // A channel to send control messages to the client handler
+	publicip     net.IP         // client public ip
+	name         string         // name of the authenticated client
+	groups       []string       // groups the client identity belongs to
+	mtu          int            // tunnel MTU negotiated with the client
+	subnets      []*net.IPNet   // subnets behind the client that it serves as a gateway for
+	session      string         // token that further striped connections present to join this client
+	upload       []*tokenbucket // rate limits on packets from the client
+	download     []*tokenbucket // rate limits on packets to the client
+	// The stripe goroutine reads packets from this queue and spreads them over the tx channels of the client's connections
+	// A goroutine in the router reads packets from the tun interface and writes any destined for this client ip, to this queue
+	// Made by the client handler once the MTU is negotiated
+	tx      *pktqueue
+	join    chan chan *message // striped connections register their tx channel here
+	leave   chan chan *message // striped connections unregister their tx channel here
+	gone    chan bool          // closed when the stripe goroutine exits
+	control chan string        // A channel to send the client handler the reason to disconnect the client
+}
+
+// Packets and bytes moved by a client's session, counted by its pumps
+// Up is from the client, down is to it, like the rate limits
+type traffic struct {
+	uppackets   uint64
+	upbytes     uint64
+	downpackets uint64
+	downbytes   uint64
+}
+
+// Count a packet of n bytes from the client
+func (t *traffic) up(n int) {
+	atomic.AddUint64(&t.uppackets, 1)
+	atomic.AddUint64(&t.upbytes, uint64(n))
+}
+
+// Count a packet of n bytes to the client
+func (t *traffic) down(n int) {
+	atomic.AddUint64(&t.downpackets, 1)
+	atomic.AddUint64(&t.downbytes, uint64(n))
+}
+
+// A consistent enough copy of the counts while the pumps are running
+func (t *traffic) snapshot() traffic {
+	return traffic{
+		uppackets:   atomic.LoadUint64(&t.uppackets),
+		upbytes:     atomic.LoadUint64(&t.upbytes),
+		downpackets: atomic.LoadUint64(&t.downpackets),
+		downbytes:   atomic.LoadUint64(&t.downbytes),
+	}
 }
 
 // Creates a new Client given a tls connection
@@ -72,10 +122,75 @@ func NewClient(tlscon *tls.Conn) (*Client, error) {
 	// TODO: Do we need to do anything special to get the real remote address behind loadbalancer?
 	ipstring := tlscon.RemoteAddr().String()
 
+	// Token for joining striped connections to this client
+	session, err := randToken()
+	if err != nil {
+		return nil, err
+	}
+
 	return &Client{
 		name:      name,
+		groups:    clientgroups(name),
+		session:   session,
 		connected: time.Now(),
 		publicip:  net.ParseIP(ipstring[0:strings.Index(ipstring, ":")]),
-		tx:        make(chan *message, 1000),
+		join:      make(chan chan *message),
+		leave:     make(chan chan *message),
+		gone:      make(chan bool),
+		control:   make(chan string, 1),
 	}, nil
 }
+
+// Find the groups an identity belongs to from the groups section of the config
+// Each group is a list of the identities in it
+func clientgroups(name string) []string {
+	var groups map[string][]string
+	if err := config.Get("groups").Scan(&groups); nil != err {
+		log.Printf("server: failed reading groups: %s", err)
+		return nil
+	}
+
+	var member []string
+	for group, names := range groups {
+		for _, other := range names {
+			if other == name {
+				member = append(member, group)
+				break
+			}
+		}
+	}
+	return member
+}
+
+// Check if the client is a member of group
+func (c *Client) ingroup(group string) bool {
+	for _, other := range c.groups {
+		if other == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the client may send packets from the 4 or 16 byte source address src
+// Gateway clients send from the subnets they serve as well as their tunnel addresses
+func (c *Client) owns(src []byte) bool {
+	if len(src) == 4 && ip2int(src) == c.intip || len(src) == 16 && c.ip6 != nil && c.ip6.Equal(src) {
+		return true
+	}
+	for _, subnet := range c.subnets {
+		if subnet.Contains(src) {
+			return true
+		}
+	}
+	return false
+}
+
+// The MTU to clamp the MSS of the client's TCP SYNs to, zero when clamping is disabled
+// mss.Clamp leaves room for the headers of each packet's family
+func (c *Client) clampmtu() int {
+	if !config.Get("tun", "mssclamp").Bool(true) {
+		return 0
+	}
+	return c.mtu
+}
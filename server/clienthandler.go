@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -16,20 +17,63 @@ import (
 // Info that the client sends in its first packet after connection
 // encoded as json
 type ClientInfo struct {
-	Time    string `json:"time"`
-	Version string `json:"version"`
+	Time    string   `json:"time"`
+	Version string   `json:"version"`
+	Session string   `json:"session,omitempty"` // set by striped connections joining an existing session
+	MTU     int      `json:"mtu,omitempty"`     // the largest tunnel MTU the client supports
+	Subnets []string `json:"subnets,omitempty"` // subnets behind the client that it offers to serve as a gateway for
 }
 
 // Settings to send json encoded as the first packet to the client after reading
 // its first packet which contains ClientInfo
 type ClientSettings struct {
-	Time    string `json:"time"`
-	Version string `json:"version"`
-	IP      string `json:"ip"`
+	Time    string   `json:"time"`
+	Version string   `json:"version"`
+	IP      string   `json:"ip"`
+	Session string   `json:"session"`           // token for joining further striped connections to this session
+	MTU     int      `json:"mtu"`               // the negotiated tunnel MTU
+	Subnets []string `json:"subnets,omitempty"` // subnets the client serves as a gateway for
+	IP6     string   `json:"ip6,omitempty"`     // the client's tunnel IPv6 address and prefix length, when the tunnel is dual-stack
+	Prefix  int      `json:"prefix,omitempty"`  // the prefix length of the address pool the client's IP is from
+	Routes  []string `json:"routes,omitempty"`  // the other address pools, routed through the tunnel
+}
+
+// Sent json encoded in place of ClientSettings when the server refuses the client
+type HandshakeError struct {
+	Error string `json:"error"` // why the client was refused, for it to show
+}
+
+// Sent json encoded in a frame of its own when the server disconnects a connected client
+// Control frames are told apart from packets by not starting with an IPv4 or IPv6 version nibble
+type ControlFrame struct {
+	Disconnect string `json:"disconnect"` // why the client was disconnected, for it to show
+}
+
+// Write a control frame to the client
+func sendcontrol(conn net.Conn, frame ControlFrame) error {
+	body, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	copy(buf[4:], body)
+	_, err = conn.Write(buf)
+	return err
+}
+
+// Refuse a client's handshake with an HTTP error status line and a HandshakeError body
+func refusehandshake(conn net.Conn, status string, reason string) {
+	body, _ := json.Marshal(HandshakeError{Error: reason})
+	conn.Write([]byte(fmt.Sprintf("HTTP/1.0 %s\n", status)))
+	conn.Write([]byte("Content-Type: application/json\n"))
+	conn.Write([]byte(fmt.Sprintf("Content-Length: %d\n\n", len(body))))
+	conn.Write(body)
 }
 
 // Client handler function for :443
-func (s *Service) serve(conn net.Conn, tun chan<- *message, clientstate chan<- ClientState, bufpool *sync.Pool, netblock <-chan net.IP) {
+func (s *Service) serve(conn net.Conn, tun flowdispatch, clientstate chan<- ClientState, bufpool *sync.Pool, ipam IPAM, sessions chan<- SessionReq, admissions chan<- AdmitReq, blocks *blocklist, drain *drainstate, peers *hairpin, flood *floodpolicy, acl *aclengine, limits *ratelimits, serverip uint32, replyinterval time.Duration, servernet6 *net.IPNet, mtu int) {
 	defer func() {
 		// Close connection when handler exits
 		conn.Close()
@@ -41,6 +85,7 @@ func (s *Service) serve(conn net.Conn, tun chan<- *message, clientstate chan<- C
 	// Metrics to track
 	tlsfail := client_failmetric.WithLabelValues("tls")
 	nocertfail := client_failmetric.WithLabelValues("nocert")
+	sessionfail := client_failmetric.WithLabelValues("session")
 
 	// Get a random connection id
 	id, err := randUint64()
@@ -82,12 +127,25 @@ func (s *Service) serve(conn net.Conn, tun chan<- *message, clientstate chan<- C
 		nocertfail.Inc()
 		cprintf("(term): error validating client: %s", err)
 
-		//Send HTTP 403 response
-		conn.Write([]byte("HTTP/1.0 403 FORBIDDEN\n\n"))
+		refusehandshake(conn, "403 FORBIDDEN", "client certificate not accepted")
 		return
 	}
 	client.id = id
 
+	// Identities blocked through the admin API are refused until the block expires
+	if block, ok := blocks.blocked(client.name); ok {
+		cprintf("(term): %s is blocked until %s: %s", client.name, block.Expires.UTC().Format(time.RFC3339), block.Reason)
+
+		refusehandshake(conn, "403 FORBIDDEN", "blocked: "+block.Reason)
+		return
+	}
+
+	// The connected client owning the session when this is a striped connection
+	var session *Client
+
+	// Set once the connect client state is sent, after which runblock releases the client's address
+	var connected bool
+
 	// Application-Layer Handshake
 	// Read first packet from client
 	// This is ugly because we're not in channel-land yet
@@ -138,15 +196,118 @@ func (s *Service) serve(conn net.Conn, tun chan<- *message, clientstate chan<- C
 
 		// TODO: Validate client info
 
-		// Allocate client IP address
-		client.ip = <-netblock
-		client.intip = ip2int(client.ip)
+		if info.Session != "" {
+			// Find the client that owns the session being joined
+			respchan := make(chan *Client)
+			sessions <- SessionReq{token: info.Session, resp: respchan}
+			session = <-respchan
+
+			// Only the identity that owns a session may join it
+			if session == nil || session.name != client.name {
+				sessionfail.Inc()
+				cprint("(term): invalid session token")
+
+				refusehandshake(conn, "403 FORBIDDEN", "invalid session token")
+				return
+			}
+		} else {
+			// A draining server takes no new sessions, so the client can try another
+			if reason, ok := drain.draining(); ok {
+				cprintf("(term): refused while draining: %s", reason)
+				refusehandshake(conn, "503 SERVICE UNAVAILABLE", reason)
+				return
+			}
+
+			// Refused here when the identity is at its session limit and its oldest sessions win, so the client never connects
+			respchan := make(chan string)
+			admissions <- AdmitReq{client: client, resp: respchan}
+			if reason := <-respchan; reason != "" {
+				cprintf("(term): refused: %s", reason)
+				refusehandshake(conn, "403 FORBIDDEN", reason)
+				return
+			}
+
+			// Give back the admission if the handshake fails before the client connects
+			defer func() {
+				if !connected {
+					admissions <- AdmitReq{client: client, cancel: true}
+				}
+			}()
+
+			// Negotiate the smaller of the two MTUs, clients that don't say get the server's
+			client.mtu = mtu
+			if info.MTU != 0 && info.MTU < mtu {
+				client.mtu = info.MTU
+			}
+			if client.mtu < MinMTU {
+				reason := fmt.Sprintf("mtu %d is below the minimum %d", client.mtu, MinMTU)
+				cprintf("(term): refused: %s", reason)
+				refusehandshake(conn, "400 BAD REQUEST", reason)
+				return
+			}
+
+			// Subnets the client is allowed to be the gateway for
+			var refused []string
+			client.subnets, refused = clientsubnets(client.name, info.Subnets)
+			for _, cidr := range refused {
+				cprintf("refused unauthorized subnet %s", cidr)
+			}
+
+			// Rate limits for the identity and its groups
+			client.upload, client.download = limits.buckets(client)
+			defer limits.release(client)
+
+			// The managed queue of packets to the client
+			client.tx = newpktqueue(client.name, client.mtu, bufpool)
+
+			// Closed by contrack once the client connects, here if the handshake fails before that
+			defer func() {
+				if !connected {
+					client.tx.close()
+				}
+			}()
+
+			// Allocate client IP address from the pool that selects it, the identity's last one when it's free
+			// Refused straight away when the pool is exhausted, so the client can tell the user why
+			if client.ip, client.pool, client.sticky = ipam.Allocate(client); client.ip == nil {
+				cprint("(term): no addresses available")
+				refusehandshake(conn, "503 SERVICE UNAVAILABLE", "no addresses available")
+				return
+			}
+			client.intip = ip2int(client.ip)
+
+			// Give the address back if the handshake fails before the client connects
+			defer func() {
+				if !connected {
+					ipam.Release(client.ip)
+				}
+			}()
+
+			// The IPv6 address at the same offset in the IPv6 prefix, when the tunnel can carry IPv6
+			if servernet6 != nil && client.mtu >= IPv6MinMTU {
+				client.ip6 = addr6(servernet6.IP.Mask(servernet6.Mask), client.intip-(serverip-1))
+			}
+			session = client
+		}
 
 		// Create client settings to send
 		settings := ClientSettings{
 			Time:    time.Now().UTC().Format(time.RFC3339),
 			Version: "0.1.0",
-			IP:      client.ip.String(),
+			IP:      session.ip.String(),
+			Session: session.session,
+			MTU:     session.mtu,
+		}
+		for _, subnet := range session.subnets {
+			settings.Subnets = append(settings.Subnets, subnet.String())
+		}
+		settings.Prefix, _ = session.pool.ipnet.Mask.Size()
+		for _, ipnet := range session.pool.routes {
+			settings.Routes = append(settings.Routes, ipnet.String())
+		}
+		if session.ip6 != nil {
+			ones, _ := servernet6.Mask.Size()
+			settings.IP6 = fmt.Sprintf("%s/%d", session.ip6, ones)
 		}
 
 		// Encode client settings struct to newline delimited json and send as first packet
@@ -178,6 +339,22 @@ func (s *Service) serve(conn net.Conn, tun chan<- *message, clientstate chan<- C
 
 	// Enter channel-land! Ye blessed routine
 
+	// Striped connections only pump packets for the client owning the session
+	if session != client {
+		s.servestripe(conn, session, tun, peers, flood, acl, serverip, replyinterval, bufpool, cprint)
+		return
+	}
+
+	// The tx channel for this connection, fed by the stripe goroutine
+	txchan := make(chan *message, stripequeue)
+
+	// Spreads packets routed to the client across its striped connections
+	// Exits when contrack closes client.tx after the disconnect client state
+	go stripe(client, txchan, bufpool)
+
+	// Why the handler is leaving, for the disconnect client state
+	reason := "handler exited"
+
 	// Defer client cleanup to when leaving the handler
 	defer func() {
 		// Record disconnect time in client
@@ -188,14 +365,16 @@ func (s *Service) serve(conn net.Conn, tun chan<- *message, clientstate chan<- C
 
 		// Send disconnect client state change
 		clientstate <- ClientState{
-			happened:   time.Now(),
+			happened:   client.disconnected,
 			transition: Disconnect,
 			client:     client,
+			reason:     reason,
 		}
 	}()
 
 	// Increment connect count metric here
 	client_connectmetric.Inc()
+	connected = true
 
 	// Send client connect state change
 	// This causes the client.tx channel to be mounted by the tun router and it will now receieve traffic
@@ -209,12 +388,15 @@ func (s *Service) serve(conn net.Conn, tun chan<- *message, clientstate chan<- C
 	// Exits on failing read after deferred conn.Close() or client disconnect
 	readerr := make(chan bool)
 	s.clientGroup.Add(1)
-	go connrx(conn, tun, client.intip, readerr, s.clientGroup, bufpool)
+	go connrx(conn, tun, client, peers, flood, acl, serverip, replyinterval, client.clampmtu(), readerr, s.clientGroup, bufpool)
+
+	// Control frames are written between the packets conntx writes
+	wconn := &lockedconn{Conn: conn}
 
 	// Consumer that pumps messages from the router into the client connection
 	writeerr := make(chan bool)
 	s.clientGroup.Add(1)
-	go conntx(client.tx, conn, writeerr, s.clientGroup, bufpool)
+	go conntx(txchan, wconn, client, writeerr, s.clientGroup, bufpool)
 
 	cprint("client connection established")
 
@@ -225,23 +407,84 @@ func (s *Service) serve(conn net.Conn, tun chan<- *message, clientstate chan<- C
 		// Disconnect if we're told to shut down shop
 		case <-s.done:
 			cprint("(term): got done signal")
+			reason = "server shutting down"
 			return
 
 		case <-readerr:
 			cprint("(term): encountered client read error")
+			reason = "connection closed or read failed"
 			return
 
 		case <-writeerr:
 			cprint("(term): encountered client write error")
+			reason = "write failed"
 			return
 
-		// Handle client control messages
-		case _, ok := <-client.control:
-			// Leave the loop if we are to disconnect
-			if !ok {
-				cprint("(term): received disconnect control")
-				return
+		// Disconnect the client when told to, letting it know why
+		case reason = <-client.control:
+			cprintf("(term): received disconnect control: %s", reason)
+			if err := sendcontrol(wconn, ControlFrame{Disconnect: reason}); err != nil {
+				cprintf("error sending disconnect reason: %s", err)
 			}
+			return
+		}
+	}
+}
+
+// Handler for a striped connection that joined the session of a connected client
+// Packets from the connection go to the tun like those of the client's first connection
+// Its tx channel is registered with the client's stripe goroutine until the connection ends
+// The client stays connected when a striped connection ends, but not the other way around
+func (s *Service) servestripe(conn net.Conn, client *Client, tun flowdispatch, peers *hairpin, flood *floodpolicy, acl *aclengine, serverip uint32, replyinterval time.Duration, bufpool *sync.Pool, cprint func(interface{})) {
+	txchan := make(chan *message, stripequeue)
+
+	// Register with the stripe goroutine, unless the client has already disconnected
+	select {
+	case client.join <- txchan:
+	case <-client.gone:
+		cprint("(term): session ended before join")
+		return
+	}
+
+	// Unregister when leaving, the stripe goroutine closes txchan which stops conntx
+	defer func() {
+		select {
+		case client.leave <- txchan:
+		case <-client.gone:
+		}
+	}()
+
+	// Producer that pumps the read-side of the connection into the vpn tun adapter
+	readerr := make(chan bool)
+	s.clientGroup.Add(1)
+	go connrx(conn, tun, client, peers, flood, acl, serverip, replyinterval, client.clampmtu(), readerr, s.clientGroup, bufpool)
+
+	// Consumer that pumps messages from the stripe goroutine into the connection
+	writeerr := make(chan bool)
+	s.clientGroup.Add(1)
+	go conntx(txchan, conn, client, writeerr, s.clientGroup, bufpool)
+
+	client_stripemetric.Inc()
+	cprint("striped connection established")
+
+	for {
+		select {
+		case <-s.done:
+			cprint("(term): got done signal")
+			return
+
+		case <-readerr:
+			cprint("(term): encountered client read error")
+			return
+
+		case <-writeerr:
+			cprint("(term): encountered client write error")
+			return
+
+		// The client's first connection ended
+		case <-client.gone:
+			cprint("(term): session ended")
+			return
 		}
 	}
 }
@@ -1,19 +1,123 @@
 package main
 
 import (
+	"fmt"
 	"log"
-	"time"
+
+	"github.com/micro/go-micro/v2/config"
 )
 
-func contrack(subchan chan<- ClientStateSub, reportchan <-chan chan<- Connections) {
+// How a client's sessions beyond its limit are resolved
+type sessionmode int
+
+const (
+	sessionNewest sessionmode = iota // The newest sessions stay, displacing the oldest
+	sessionOldest                    // The oldest sessions stay, rejecting new ones
+)
+
+// The concurrent sessions an identity may have, and which win when it has too many
+type sessionpolicy struct {
+	mode  sessionmode
+	limit int
+}
+
+// Read a session policy from the config at path, returning def where it is unset
+func readsessionpolicy(def sessionpolicy, path ...string) (sessionpolicy, bool) {
+	var cfg struct {
+		Policy string `json:"policy"`
+		Limit  int    `json:"limit"`
+	}
+	if err := config.Get(path...).Scan(&cfg); nil != err || (cfg.Policy == "" && cfg.Limit == 0) {
+		return def, false
+	}
+
+	policy := def
+	switch cfg.Policy {
+	case "":
+	case "newest":
+		policy.mode = sessionNewest
+	case "oldest":
+		policy.mode = sessionOldest
+	default:
+		log.Printf("server: contrack: unknown session policy %q at %v", cfg.Policy, path)
+	}
+	if cfg.Limit > 0 {
+		policy.limit = cfg.Limit
+	}
+	return policy, true
+}
+
+// Find the session policy of a client
+// The identity's own policy in session.identities wins, then the most permissive of its groups' in session.groups, then session's
+func clientsessionpolicy(client *Client) sessionpolicy {
+	def, _ := readsessionpolicy(sessionpolicy{mode: sessionNewest, limit: 1}, "session")
+
+	if policy, ok := readsessionpolicy(def, "session", "identities", client.name); ok {
+		return policy
+	}
+
+	var found bool
+	best := def
+	for _, group := range client.groups {
+		policy, ok := readsessionpolicy(def, "session", "groups", group)
+		if ok && (!found || policy.limit > best.limit || (policy.limit == best.limit && policy.mode == sessionNewest)) {
+			best, found = policy, true
+		}
+	}
+	return best
+}
+
+// Tell a client's handler to disconnect it, sending it reason
+// Only the first reason is sent when a client is told more than once
+func kick(client *Client, reason string) {
+	select {
+	case client.control <- reason:
+	default:
+	}
+}
+
+// Asks contrack to admit a new session of client during its handshake, or to cancel an admitted one whose handshake failed
+// Why the session is refused is sent on resp, empty when it is admitted, nothing is sent for a cancel
+type AdmitReq struct {
+	client *Client
+	cancel bool
+	resp   chan<- string
+}
+
+// Tracks the sessions of connected clients, enforcing the session policy of each identity
+// New sessions over the limit of an identity whose oldest sessions win are refused during their handshake, before they connect
+// Clients displaced by the policy are told why and wait in deltrack until they disconnect
+// Disconnect requests from the admin API are resolved the same way, displacing the matching open sessions
+func contrack(subchan chan<- ClientStateSub, reportchan <-chan chan<- Connections, sessionchan <-chan SessionReq, admitchan <-chan AdmitReq, disconnectchan <-chan DisconnectReq) {
 	// Metrics to track
 	delcount := contrack_trackedmetric.WithLabelValues("delwait")
 	opencount := contrack_trackedmetric.WithLabelValues("open")
 
 	log.Print("server: contrack: starting")
 
-	contrack := make(map[string]*Client) // Like open
-	deltrack := make(map[uint64]*Client) // Like close_wait
+	contrack := make(map[string][]*Client) // Like open, the sessions of each identity oldest first
+	deltrack := make(map[uint64]*Client)   // Like close_wait
+	sessions := make(map[string]*Client)   // Connected clients by session token
+	admitted := make(map[string]int)       // Sessions of each identity admitted and still handshaking
+
+	// Forget a session that was admitted, once it connects or fails its handshake
+	unadmit := func(name string) {
+		if admitted[name]--; admitted[name] <= 0 {
+			delete(admitted, name)
+		}
+	}
+
+	// Stop tracking a client as open and wait for it to disconnect
+	displace := func(client *Client, reason string) {
+		log.Printf("server: contrack: enforce disconnect on %s-%#x: %s", client.name, client.id, reason)
+		kick(client, reason)
+
+		// Save the disconnecting client into the deltrack list to await its final goodbye
+		log.Printf("server: contrack: saving to deltrack %s-%#x", client.name, client.id)
+		deltrack[client.id] = client
+		delcount.Inc()
+		delete(sessions, client.session)
+	}
 
 	// Channel to receive client state
 	statechan := make(chan ClientState)
@@ -21,8 +125,6 @@ func contrack(subchan chan<- ClientStateSub, reportchan <-chan chan<- Connection
 	// Subscribe to client state stream
 	subchan <- ClientStateSub{name: "contrack", subchan: statechan}
 
-	// TODO: Handle metrics/reporting
-
 	// Pump the statechan for changes in client state and update our contrack tables
 	for {
 		select {
@@ -33,29 +135,36 @@ func contrack(subchan chan<- ClientStateSub, reportchan <-chan chan<- Connection
 			}
 
 			if state.transition == Connect {
-				// See if we have any existing client connections with this name
-				other, ok := contrack[state.client.name]
-				if ok {
-					// Enforce single connection per client by disconnecting any existing connections for the client name
-					if (other.disconnected == time.Time{}) {
-						// Only send if it isn't disconnected already
-						contrack_enforcedmetric.Inc()
-						log.Printf("server: contrack: enforce disconnect on %s-%#x", other.name, other.id)
-						//TODO: close(other.control)
-					}
-					// Save the disconnecting client into the deltrack list to await its final goodbye
-					log.Printf("server: contrack: saving to deltrack %s-%#x", other.name, other.id)
-					deltrack[other.id] = other
+				unadmit(state.client.name)
+				policy := clientsessionpolicy(state.client)
+				open := contrack[state.client.name]
 
-					delcount.Inc()
-				} else {
-					opencount.Inc()
+				// Sessions over the limit when the oldest win were refused at admission
+				// One can still get here when the limit was lowered during its handshake, and stays rather than disturb the routes
+				if len(open) >= policy.limit && policy.mode == sessionNewest {
+					// The newcomer wins over the identity's oldest sessions
+					excess := len(open) - policy.limit + 1
+					for _, other := range open[:excess] {
+						contrack_enforcedmetric.WithLabelValues("displaced").Inc()
+						displace(other, fmt.Sprintf("session limit of %d reached, displaced by a newer session", policy.limit))
+						opencount.Dec()
+					}
+					open = open[excess:]
+				} else if len(open) != 0 {
+					contrack_enforcedmetric.WithLabelValues("allowed").Inc()
 				}
 
 				log.Printf("server: contrack: tracking %s-%#x", state.client.name, state.client.id)
-				contrack[state.client.name] = state.client
+				contrack[state.client.name] = append(open[:len(open):len(open)], state.client)
+				sessions[state.client.session] = state.client
+				opencount.Inc()
 
 			} else if state.transition == Disconnect {
+				// No more connections may join the client's session
+				if sessions[state.client.session] == state.client {
+					delete(sessions, state.client.session)
+				}
+
 				// When a client disconnects reap the client lists
 				if _, ok := deltrack[state.client.id]; ok {
 					log.Printf("server: contrack: deltrack closed %s-%#x", state.client.name, state.client.id)
@@ -65,51 +174,102 @@ func contrack(subchan chan<- ClientStateSub, reportchan <-chan chan<- Connection
 
 					delcount.Dec()
 				} else {
-					// If there is an existing contrack entry
-					if client, ok := contrack[state.client.name]; ok && client.id == state.client.id {
-						// With the same connection id
-						log.Printf("server: contrack: closed last open for %s-%#x", state.client.name, state.client.id)
-						// Remove the client from the connection tracking list
-						delete(contrack, state.client.name)
-						opencount.Dec()
-					} else {
+					// Find the open session with the same connection id
+					open := contrack[state.client.name]
+					found := -1
+					for i, client := range open {
+						if client.id == state.client.id {
+							found = i
+						}
+					}
+					if found == -1 {
 						log.Printf("server: contrack(perm): got disconnect with zero tracking matches %s-%#x", state.client.name, state.client.id)
 						panic("zero tracking matches")
 					}
+
+					log.Printf("server: contrack: closed open for %s-%#x", state.client.name, state.client.id)
+					// Remove the client from the connection tracking list
+					if len(open) == 1 {
+						delete(contrack, state.client.name)
+					} else {
+						contrack[state.client.name] = append(open[:found:found], open[found+1:]...)
+					}
+					opencount.Dec()
 				}
 
-				// Close the client channel so the send pump shuts down
-				close(state.client.tx)
+				// Close the client queue so the send pump shuts down
+				state.client.tx.close()
 			} else {
 				log.Printf("server: contrack(perm): unhandled client transition: %d", state.transition)
 				panic("unhandled client state transition")
 			}
 
+		// Find the client for a striped connection's session token
+		case req := <-sessionchan:
+			req.resp <- sessions[req.token]
+
+		// Admit a new session unless the identity's oldest sessions win and it is at its limit
+		// Sessions still handshaking count against the limit, so two can't both take the last place
+		case req := <-admitchan:
+			if req.cancel {
+				unadmit(req.client.name)
+				continue
+			}
+
+			policy := clientsessionpolicy(req.client)
+			if policy.mode == sessionOldest && len(contrack[req.client.name])+admitted[req.client.name] >= policy.limit {
+				log.Printf("server: contrack: rejecting new session of %s-%#x, at its limit of %d", req.client.name, req.client.id, policy.limit)
+				contrack_enforcedmetric.WithLabelValues("rejected").Inc()
+				req.resp <- fmt.Sprintf("session limit of %d reached, newer sessions are rejected", policy.limit)
+				continue
+			}
+
+			admitted[req.client.name]++
+			req.resp <- ""
+
+		// Disconnect open sessions by id, all of an identity's, or all of them
+		case req := <-disconnectchan:
+			var count int
+			for name, open := range contrack {
+				if !req.all && req.id == 0 && name != req.name {
+					continue
+				}
+
+				var kept []*Client
+				for _, client := range open {
+					if req.all || client.id == req.id || (req.id == 0 && client.name == req.name) {
+						contrack_enforcedmetric.WithLabelValues("kicked").Inc()
+						displace(client, req.reason)
+						opencount.Dec()
+						count++
+					} else {
+						kept = append(kept, client)
+					}
+				}
+
+				if len(kept) == 0 {
+					delete(contrack, name)
+				} else {
+					contrack[name] = kept
+				}
+			}
+			req.resp <- count
+
 		// Bundle up our connection info and send it over
 		case req := <-reportchan:
 			// Collection of report connections
 			var cons Connections
 
 			// Report active connections
-			for _, v := range contrack {
-				cons = append(cons, Connection{
-					Time:     v.connected,
-					Name:     v.name,
-					IP:       v.ip.String(),
-					PublicIP: v.publicip.String(),
-					Pending:  false,
-				})
+			for _, open := range contrack {
+				for _, v := range open {
+					cons = append(cons, connection(v, false))
+				}
 			}
 
 			// Report delwait connections
 			for _, v := range deltrack {
-				cons = append(cons, Connection{
-					Time:     v.connected,
-					Name:     v.name,
-					IP:       v.ip.String(),
-					PublicIP: v.publicip.String(),
-					Pending:  true,
-				})
+				cons = append(cons, connection(v, true))
 			}
 
 			// Send the list to the delivered channel
@@ -117,3 +277,32 @@ func contrack(subchan chan<- ClientStateSub, reportchan <-chan chan<- Connection
 		}
 	}
 }
+
+// Make the report of a client's session, pending when it is waiting to disconnect
+func connection(v *Client, pending bool) Connection {
+	var subnets []string
+	for _, subnet := range v.subnets {
+		subnets = append(subnets, subnet.String())
+	}
+
+	traffic := v.traffic.snapshot()
+	return Connection{
+		ID:       fmt.Sprintf("%#x", v.id),
+		Time:     v.connected,
+		Name:     v.name,
+		Groups:   v.groups,
+		IP:       v.ip.String(),
+		IP6:      ip6string(v.ip6),
+		PublicIP: v.publicip.String(),
+		Pool:     v.pool.name,
+		Sticky:   v.sticky,
+		MTU:      v.mtu,
+		Subnets:  subnets,
+		Pending:  pending,
+
+		UpPackets:   traffic.uppackets,
+		UpBytes:     traffic.upbytes,
+		DownPackets: traffic.downpackets,
+		DownBytes:   traffic.downbytes,
+	}
+}
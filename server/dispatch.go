@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/joshperry/govpn/flow"
+)
+
+// The channels of a set of workers that packets are spread across by flow
+// Every packet of a flow goes to the same worker, so flows stay in order while the workers run in parallel
+type flowdispatch []chan *message
+
+// Make a dispatch with a channel for each of n workers
+func newflowdispatch(n int) flowdispatch {
+	d := make(flowdispatch, n)
+	for i := range d {
+		d[i] = make(chan *message)
+	}
+	return d
+}
+
+// Send a message to the worker for its flow
+func (d flowdispatch) send(msg *message) {
+	d[flow.Hash(msg.packet[:msg.len])%uint32(len(d))] <- msg
+}
+
+// Close all of the worker channels
+func (d flowdispatch) close() {
+	for _, ch := range d {
+		close(ch)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A UDP packet of flow to dst carrying its sequence number in the flow
+func flowpacket(msg *message, flow int, seq uint32, dst net.IP) {
+	msg.clr()
+	packet := msg.packet[:128]
+	for i := range packet {
+		packet[i] = 0
+	}
+
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:16], net.IPv4(10, 0, 0, 1).To4())
+	copy(packet[16:20], dst.To4())
+	binary.BigEndian.PutUint16(packet[10:], checksum(packet[:20]))
+
+	binary.BigEndian.PutUint16(packet[20:], uint16(10000+flow))
+	binary.BigEndian.PutUint16(packet[22:], 53)
+	binary.BigEndian.PutUint16(packet[24:], uint16(len(packet)-20))
+	binary.BigEndian.PutUint32(packet[28:], seq)
+
+	msg.set(len(packet))
+}
+
+// Push packets of many flows through the dispatch and routers into the client queues, checking that every flow arrives in order
+func benchdispatch(b *testing.B, routercount int, flows int, producers int) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	bufpool := &sync.Pool{New: func() interface{} { return newmessage(1400) }}
+
+	// Clients to route the flows to
+	routes := newsharedroutes()
+	tables := routes.tables.Load().(routetables)
+	clients := make([]*Client, 4)
+	for i := range clients {
+		clients[i] = &Client{
+			name: fmt.Sprintf("bench%d", i),
+			ip:   net.IPv4(10, 8, 0, byte(2+i)),
+			mtu:  1400,
+		}
+		clients[i].tx = newpktqueue(clients[i].name, clients[i].mtu, bufpool)
+
+		// Nothing is dropped, so every packet is checked
+		clients[i].tx.limit = 1 << 30
+		clients[i].tx.target = time.Hour
+		tables = tables.insert(clients[i].ip.To4(), 32, clients[i])
+	}
+	routes.tables.Store(tables)
+
+	// Checks the order of the packets of each flow leaving a client's queue, until finish is closed and the queue is empty
+	var delivered, reordered int
+	var mu sync.Mutex
+	var consumers sync.WaitGroup
+	finish := make(chan bool)
+	for _, client := range clients {
+		consumers.Add(1)
+		go func(client *Client) {
+			defer consumers.Done()
+			last := make(map[int]uint32)
+			count, bad := 0, 0
+			drain := func() {
+				for msg := client.tx.pop(); msg != nil; msg = client.tx.pop() {
+					flow := int(binary.BigEndian.Uint16(msg.packet[20:])) - 10000
+					seq := binary.BigEndian.Uint32(msg.packet[28:])
+					if prev, ok := last[flow]; ok && seq <= prev {
+						bad++
+					}
+					last[flow] = seq
+					count++
+					bufpool.Put(msg)
+				}
+			}
+			for {
+				select {
+				case <-client.tx.ready:
+					drain()
+				case <-finish:
+					drain()
+					mu.Lock()
+					delivered += count
+					reordered += bad
+					mu.Unlock()
+					return
+				}
+			}
+		}(client)
+	}
+
+	tun := newflowdispatch(1)
+	go func() {
+		for msg := range tun[0] {
+			bufpool.Put(msg)
+		}
+	}()
+	defer tun.close()
+
+	routers := newflowdispatch(routercount)
+	acl := newaclengine()
+	flood := newfloodpolicy(routes, nil)
+	var wait sync.WaitGroup
+	for _, rxchan := range routers {
+		wait.Add(1)
+		go route(rxchan, tun, routes, flood, acl, ip2int(net.IPv4(10, 8, 0, 1)), 0, bufpool, &wait)
+	}
+
+	// Each producer owns some of the flows, like the tun queues that read them, and sends its share of the packets round robin across them
+	if producers > flows {
+		producers = flows
+	}
+	b.ResetTimer()
+	var producing sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		producing.Add(1)
+		go func(p int) {
+			defer producing.Done()
+			owned := (flows - p + producers - 1) / producers
+			seqs := make(map[int]uint32)
+			for k := 0; k*producers+p < b.N; k++ {
+				flow := p + producers*(k%owned)
+				seqs[flow]++
+
+				msg := bufpool.Get().(*message)
+				flowpacket(msg, flow, seqs[flow], clients[flow%len(clients)].ip)
+				routers.send(msg)
+			}
+		}(p)
+	}
+	producing.Wait()
+
+	// Every packet has been taken by a router, let them deliver it and stop
+	close(routes.done)
+	wait.Wait()
+	b.StopTimer()
+
+	close(finish)
+	consumers.Wait()
+	for _, client := range clients {
+		client.tx.close()
+	}
+
+	if delivered != b.N {
+		b.Errorf("delivered %d of %d packets", delivered, b.N)
+	}
+	if reordered != 0 {
+		b.Errorf("%d of %d packets were out of order in their flow", reordered, delivered)
+	}
+}
+
+func BenchmarkDispatchOrder(b *testing.B) {
+	for _, routercount := range []int{1, 4, 8} {
+		for _, flows := range []int{1, 64, 1024} {
+			b.Run(fmt.Sprintf("routers=%d/flows=%d", routercount, flows), func(b *testing.B) {
+				benchdispatch(b, routercount, flows, 4)
+			})
+		}
+	}
+}
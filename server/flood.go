@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/v2/config"
+)
+
+// How broadcast or multicast packets are handled
+type floodmode int
+
+const (
+	floodDrop  floodmode = iota // Deliver to no clients
+	floodAll                    // Deliver to every client
+	floodGroup                  // Deliver to clients sharing a group with the sender
+)
+
+// How long an IGMP membership lasts without another report (RFC 3376 8.4)
+const membershipinterval = 260 * time.Second
+
+// Read a flood mode from the router section of the config
+func parseflood(key string) floodmode {
+	switch mode := config.Get("router", key).String("drop"); mode {
+	case "drop":
+		return floodDrop
+	case "flood":
+		return floodAll
+	case "group":
+		return floodGroup
+	default:
+		log.Printf("server: flood: unknown %s mode %q, dropping", key, mode)
+		return floodDrop
+	}
+}
+
+// Policy for broadcast and multicast packets, and the multicast groups clients have joined
+// Shared by all of the routers and connrx pumps
+type floodpolicy struct {
+	routes    *sharedroutes
+	broadcast floodmode
+	multicast floodmode
+	group     string   // The group that gets floods from the tun in group mode
+	peers     bool     // Clients may flood each other
+	netbcast  []uint32 // The directed broadcast addresses of the client address pools
+
+	sync.RWMutex
+	members map[uint32]map[*Client]time.Time // Snooped IGMP memberships and when they expire, guarded by the lock
+}
+
+// Make the policy from the router section of the config
+func newfloodpolicy(routes *sharedroutes, nets []*net.IPNet) *floodpolicy {
+	f := &floodpolicy{
+		routes:    routes,
+		broadcast: parseflood("broadcast"),
+		multicast: parseflood("multicast"),
+		group:     config.Get("router", "floodgroup").String(""),
+		peers:     config.Get("router", "clienttoclient").Bool(true),
+		members:   make(map[uint32]map[*Client]time.Time),
+	}
+	for _, ipnet := range nets {
+		f.netbcast = append(f.netbcast, ip2int(ipnet.IP.Mask(ipnet.Mask))|^binary.BigEndian.Uint32(ipnet.Mask))
+	}
+	return f
+}
+
+// Classify a 4 or 16 byte destination address as broadcast or multicast
+// Link-local multicast groups go to every client without anyone joining them
+func (f *floodpolicy) classify(dst []byte) (kind string, group uint32, linklocal bool) {
+	if len(dst) == 16 {
+		// No MLD snooping, so only link-local scope groups are flooded
+		if dst[0] == 0xff {
+			return "multicast", 0, dst[1]&0x0f == 2
+		}
+		return "", 0, false
+	}
+
+	addr := binary.BigEndian.Uint32(dst)
+	if addr == 0xffffffff {
+		return "broadcast", 0, false
+	}
+	for _, bcast := range f.netbcast {
+		if addr == bcast {
+			return "broadcast", 0, false
+		}
+	}
+	switch {
+	case addr>>28 == 0xe:
+		return "multicast", addr, addr>>8 == 0xe00000 // 224.0.0.0/24
+	}
+	return "", 0, false
+}
+
+// Check if the policy sends floods from sender to peer in group mode
+// Floods from the tun have no sender and go to the members of the flood group
+func (f *floodpolicy) ingroup(sender *Client, peer *Client) bool {
+	if sender == nil {
+		return f.group != "" && peer.ingroup(f.group)
+	}
+	for _, group := range sender.groups {
+		if peer.ingroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Deliver copies of a broadcast or multicast packet from sender, or from the tun when sender is nil, to the clients the policy floods it to
+// Each client's rules and MTU apply to its copy
+// Returns false if the packet isn't broadcast or multicast and should be routed as usual
+// msg is left with the caller either way
+func (f *floodpolicy) flood(sender *Client, msg *message, acl *aclengine, bufpool *sync.Pool) bool {
+	packet := msg.packet[:msg.len]
+	dst := dstaddr(packet)
+	if dst == nil {
+		return false
+	}
+
+	kind, group, linklocal := f.classify(dst)
+	if kind == "" {
+		return false
+	}
+
+	mode := f.broadcast
+	if kind == "multicast" {
+		mode = f.multicast
+	}
+	if mode == floodDrop || (sender != nil && !f.peers) {
+		flood_packetsmetric.WithLabelValues(kind, "dropped").Inc()
+		return true
+	}
+
+	now := time.Now()
+	f.RLock()
+	defer f.RUnlock()
+
+	for _, peer := range f.routes.tables.Load().(routetables).clients {
+		if peer == sender || (mode == floodGroup && !f.ingroup(sender, peer)) {
+			continue
+		}
+		if kind == "multicast" && !linklocal {
+			if expires, ok := f.members[group][peer]; !ok || now.After(expires) {
+				continue
+			}
+		}
+		if msg.len > peer.mtu || acl.eval(peer, aclIn, packet) != aclAccept {
+			continue
+		}
+
+		dup := bufpool.Get().(*message)
+		dup.clr()
+		dup.set(msg.len)
+		copy(dup.packet, packet)
+		deliver(peer, dup, bufpool)
+	}
+
+	flood_packetsmetric.WithLabelValues(kind, "flooded").Inc()
+	return true
+}
+
+// Track the multicast groups client joins and leaves from its IGMP reports
+func (f *floodpolicy) snoop(client *Client, packet []byte) {
+	if len(packet) < 20 || packet[0]>>4 != 4 || packet[9] != 2 {
+		return
+	}
+	hdrlen := (int(packet[0]) & 0x0F) * 4
+	if len(packet) < hdrlen+8 {
+		return
+	}
+	igmp := packet[hdrlen:]
+
+	switch igmp[0] {
+	case 0x12, 0x16: // Version 1 and 2 membership reports
+		f.member(client, binary.BigEndian.Uint32(igmp[4:8]), true)
+
+	case 0x17: // Version 2 leave group
+		f.member(client, binary.BigEndian.Uint32(igmp[4:8]), false)
+
+	case 0x22: // Version 3 membership report (RFC 3376 4.2)
+		records := int(binary.BigEndian.Uint16(igmp[6:8]))
+		for off := 8; records > 0 && len(igmp) >= off+8; records-- {
+			rtype := igmp[off]
+			sources := int(binary.BigEndian.Uint16(igmp[off+2:]))
+			group := binary.BigEndian.Uint32(igmp[off+4:])
+
+			switch {
+			// Excluding sources, or including some, is a join
+			case rtype == 2 || rtype == 4 || ((rtype == 1 || rtype == 5) && sources > 0):
+				f.member(client, group, true)
+			// Changing to include no sources is a leave
+			case rtype == 3 && sources == 0:
+				f.member(client, group, false)
+			}
+
+			off += 8 + 4*sources + 4*int(igmp[off+1])
+		}
+	}
+}
+
+// Record client joining or leaving a multicast group
+// Expired memberships in the group are reaped as it changes
+func (f *floodpolicy) member(client *Client, group uint32, join bool) {
+	if group>>28 != 0xe {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	now := time.Now()
+	clients := f.members[group]
+	if clients == nil {
+		clients = make(map[*Client]time.Time)
+		f.members[group] = clients
+	}
+
+	for other, expires := range clients {
+		if now.After(expires) {
+			delete(clients, other)
+		}
+	}
+
+	if join {
+		clients[client] = now.Add(membershipinterval)
+	} else {
+		delete(clients, client)
+	}
+
+	if len(clients) == 0 {
+		delete(f.members, group)
+	}
+	flood_groupsmetric.Set(float64(len(f.members)))
+}
+
+// Forget the multicast memberships of disconnected clients, so the groups don't hold onto them
+// Exits when the state channel is closed
+func floodupdates(subchan chan<- ClientStateSub, flood *floodpolicy) {
+	// Channel to receive client state
+	statechan := make(chan ClientState)
+
+	// Subscribe to client state stream
+	subchan <- ClientStateSub{name: "flood", subchan: statechan}
+
+	for state := range statechan {
+		if state.transition == Disconnect {
+			flood.forget(state.client)
+		}
+	}
+	log.Print("server: flood(term): statechan closed")
+}
+
+// Remove client from every multicast group
+func (f *floodpolicy) forget(client *Client) {
+	f.Lock()
+	defer f.Unlock()
+
+	for group, clients := range f.members {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(f.members, group)
+		}
+	}
+	flood_groupsmetric.Set(float64(len(f.members)))
+}
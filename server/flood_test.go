@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A client that disconnects is dropped from the groups it joined, without leaving them
+func TestFloodForgetsDisconnected(t *testing.T) {
+	statechan := make(chan ClientState)
+	subchan := make(chan ClientStateSub)
+	go publishstate(statechan, subchan)
+
+	// Relayed to the publisher, so the subscription is in before any state is published
+	flood := newfloodpolicy(newsharedroutes(), nil)
+	relay := make(chan ClientStateSub)
+	done := make(chan bool)
+	go func() {
+		floodupdates(relay, flood)
+		close(done)
+	}()
+	subchan <- <-relay
+
+	stays, leaves := &Client{id: 1}, &Client{id: 2}
+	flood.member(stays, 0xe0000105, true)
+	flood.member(leaves, 0xe0000105, true)
+	flood.member(leaves, 0xe0000106, true)
+
+	statechan <- ClientState{client: leaves, transition: Disconnect}
+	close(statechan)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("flood updates didn't exit")
+	}
+
+	if _, ok := flood.members[0xe0000105][leaves]; ok || len(flood.members[0xe0000105]) != 1 {
+		t.Errorf("group holds %v, want only the client that stayed", flood.members[0xe0000105])
+	}
+	if _, ok := flood.members[0xe0000106]; ok {
+		t.Error("group of only the disconnected client wasn't removed")
+	}
+}
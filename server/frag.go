@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Handles a packet that is larger than the mtu of the link it is headed for
+// IPv4 packets with DF set and IPv6 packets are answered with ICMP fragmentation needed or packet too big through reply
+// Other IPv4 packets are split into fragments that fit the mtu and passed to send
+// msg is returned to the pool
+func toobig(msg *message, mtu int, serverip uint32, send func(*message), reply func(*message), limiter *replylimiter, bufpool *sync.Pool, path string) {
+	defer bufpool.Put(msg)
+
+	packet := msg.packet[:msg.len]
+
+	// IPv6 packets are never fragmented on the way
+	if len(packet) >= 40 && packet[0]>>4 == 6 {
+		fragneeded(packet, mtu, serverip, reply, limiter, bufpool, path)
+		return
+	}
+
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		oversizemetric.WithLabelValues(path, "dropped").Inc()
+		return
+	}
+
+	// Don't fragment
+	if packet[6]&0x40 != 0 {
+		fragneeded(packet, mtu, serverip, reply, limiter, bufpool, path)
+		return
+	}
+
+	for _, frag := range fragment(packet, mtu, bufpool) {
+		send(frag)
+	}
+	oversizemetric.WithLabelValues(path, "fragmented").Inc()
+}
+
+// Answer an IPv4 packet with DF set with ICMP fragmentation needed, or an IPv6 packet with packet too big, reporting mtu as the next-hop MTU
+func fragneeded(packet []byte, mtu int, serverip uint32, reply func(*message), limiter *replylimiter, bufpool *sync.Pool, path string) {
+	v6 := len(packet) >= 40 && packet[0]>>4 == 6
+
+	var ok bool
+	if v6 {
+		var src [16]byte
+		copy(src[:], packet[8:24])
+		ok = replyable6(packet) && limiter.allow6(src)
+	} else {
+		ok = replyable(packet) && limiter.allow(binary.BigEndian.Uint32(packet[12:16]))
+	}
+	if !ok {
+		oversizemetric.WithLabelValues(path, "dropped").Inc()
+		return
+	}
+
+	icmp := bufpool.Get().(*message)
+	icmp.clr()
+	if v6 {
+		icmp.set(icmp6toobig(icmp.packet, packet, mtu))
+	} else {
+		icmp.set(icmpunreach(icmp.packet, packet, serverip, icmpFragNeeded, uint16(mtu)))
+	}
+	reply(icmp)
+
+	oversizemetric.WithLabelValues(path, "icmp").Inc()
+}
+
+// Split an IPv4 packet without DF into fragments no larger than mtu (RFC 791)
+// Only the options with the copied flag are carried in the later fragments
+func fragment(packet []byte, mtu int, bufpool *sync.Pool) []*message {
+	hdrlen := (int(packet[0]) & 0x0F) * 4
+	payload := packet[hdrlen:]
+	fragoff := int(binary.BigEndian.Uint16(packet[6:8])&0x1FFF) * 8
+	lastmf := packet[6] & 0x20
+
+	// The header of the later fragments
+	later := copiedoptions(packet[:hdrlen])
+
+	var frags []*message
+	for pos := 0; pos < len(payload); {
+		header := packet[:hdrlen]
+		if pos != 0 {
+			header = later
+		}
+		fraghdrlen := len(header)
+
+		// Fragment payloads are multiples of 8 bytes, except the last
+		size := (mtu - fraghdrlen) &^ 7
+		mf := byte(0x20)
+		if pos+size >= len(payload) {
+			size = len(payload) - pos
+			mf = lastmf
+		}
+
+		frag := bufpool.Get().(*message)
+		frag.clr()
+		frag.set(fraghdrlen + size)
+
+		copy(frag.packet, header)
+		copy(frag.packet[fraghdrlen:], payload[pos:pos+size])
+
+		frag.packet[0] = 0x40 | byte(fraghdrlen/4)
+		binary.BigEndian.PutUint16(frag.packet[2:], uint16(fraghdrlen+size))
+		binary.BigEndian.PutUint16(frag.packet[6:], uint16((fragoff+pos)/8))
+		frag.packet[6] |= mf
+		binary.BigEndian.PutUint16(frag.packet[10:], 0)
+		binary.BigEndian.PutUint16(frag.packet[10:], checksum(frag.packet[:fraghdrlen]))
+
+		frags = append(frags, frag)
+		pos += size
+	}
+
+	return frags
+}
+
+// Make the header of a later fragment of an IPv4 packet with header, keeping only the options with the copied flag
+// The options are padded with end of options to a multiple of 4 bytes
+func copiedoptions(header []byte) []byte {
+	later := append([]byte(nil), header[:20]...)
+
+	options := header[20:]
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case 0: // End of options
+			i = len(options)
+			continue
+		case 1: // No-op
+			i++
+			continue
+		}
+
+		// A malformed option ends the ones that are carried
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			break
+		}
+		optlen := int(options[i+1])
+		if options[i]&0x80 != 0 {
+			later = append(later, options[i:i+optlen]...)
+		}
+		i += optlen
+	}
+
+	for len(later)%4 != 0 {
+		later = append(later, 0)
+	}
+	return later
+}
+
+// Read the start of a packet too large for msg into it and discard the rest from rdr
+// Leaves msg holding as much of the packet as fit
+func discard(rdr io.Reader, msg *message, packetlen int) error {
+	msg.clr()
+	if _, err := io.ReadFull(rdr, msg.packet); nil != err {
+		return err
+	}
+
+	_, err := io.CopyN(ioutil.Discard, rdr, int64(packetlen-msg.len))
+	return err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Later fragments carry the options with the copied flag, and the fragments put back together make the packet
+func TestFragmentCopiedOptions(t *testing.T) {
+	bufpool := &sync.Pool{New: func() interface{} { return newmessage(1500) }}
+
+	// Record route, not copied, then router alert, copied
+	options := []byte{7, 7, 4, 0, 0, 0, 0, 0x94, 4, 0, 0, 0}
+	hdrlen := 20 + len(options)
+	packet := make([]byte, hdrlen+1000)
+	packet[0] = 0x40 | byte(hdrlen/4)
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:20], []byte{10, 8, 0, 2, 10, 8, 0, 3})
+	copy(packet[20:], options)
+	for i := hdrlen; i < len(packet); i++ {
+		packet[i] = byte(i)
+	}
+
+	const mtu = 300
+	frags := fragment(packet, mtu, bufpool)
+	if len(frags) < 2 {
+		t.Fatalf("got %d fragments, want several", len(frags))
+	}
+
+	payload := make([]byte, len(packet)-hdrlen)
+	for i, frag := range frags {
+		fp := frag.packet[:frag.len]
+		fraghdrlen := (int(fp[0]) & 0x0F) * 4
+		offset := int(binary.BigEndian.Uint16(fp[6:])&0x1FFF) * 8
+		more := fp[6]&0x20 != 0
+
+		if len(fp) > mtu {
+			t.Errorf("fragment %d is %d bytes, over the mtu", i, len(fp))
+		}
+		if checksum(fp[:fraghdrlen]) != 0xffff { // Zero, sent as all ones
+			t.Errorf("fragment %d has a bad header checksum", i)
+		}
+		if more != (i != len(frags)-1) {
+			t.Errorf("fragment %d has more fragments %t", i, more)
+		}
+		if more && (len(fp)-fraghdrlen)%8 != 0 {
+			t.Errorf("fragment %d carries %d bytes, not a multiple of 8", i, len(fp)-fraghdrlen)
+		}
+
+		want := packet[20:hdrlen]
+		if i != 0 {
+			want = []byte{0x94, 4, 0, 0}
+		}
+		if !bytes.Equal(fp[20:fraghdrlen], want) {
+			t.Errorf("fragment %d has options %x, want %x", i, fp[20:fraghdrlen], want)
+		}
+
+		copy(payload[offset:], fp[fraghdrlen:])
+	}
+
+	if !bytes.Equal(payload, packet[hdrlen:]) {
+		t.Error("the fragments don't put back together into the payload")
+	}
+}
+
+// IPv6 senders sharing the low bits of their address are each answered
+func TestFragneededIPv6Senders(t *testing.T) {
+	bufpool := &sync.Pool{New: func() interface{} { return newmessage(1500) }}
+	limiter := newreplylimiter(time.Minute)
+
+	packet := func(prefix byte) []byte {
+		p := make([]byte, 1400)
+		p[0] = 0x60
+		binary.BigEndian.PutUint16(p[4:], uint16(len(p)-40))
+		p[6] = 17
+		p[7] = 64
+		copy(p[8:24], []byte{0x20, 0x01, 0x0d, prefix, 15: 2})
+		copy(p[24:40], []byte{0x20, 0x01, 0x0d, 0xb8, 15: 3})
+		return p
+	}
+
+	var replies int
+	reply := func(msg *message) {
+		replies++
+		bufpool.Put(msg)
+	}
+	fragneeded(packet(0xb8), 1280, 0, reply, limiter, bufpool, "test")
+	fragneeded(packet(0xb9), 1280, 0, reply, limiter, bufpool, "test")
+	fragneeded(packet(0xb8), 1280, 0, reply, limiter, bufpool, "test")
+
+	if replies != 2 {
+		t.Errorf("sent %d replies, want one to each sender", replies)
+	}
+}
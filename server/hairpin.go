@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+)
+
+// Policy for packets sent from one client to another
+// Shared by all of the connrx pumps
+type hairpin struct {
+	routes  *sharedroutes
+	enabled bool // Deliver packets straight to the peer instead of through the tun
+	allow   bool // Permit client to client packets at all
+}
+
+// Handle a packet from client if it is headed for another client
+// Packets the peer's rules refuse are dropped here, rejects are answered from serverip through send
+// Returns false when the packet isn't for a peer, or should reach it through the tun
+func (h *hairpin) forward(client *Client, msg *message, acl *aclengine, serverip uint32, send func(*message), limiter *replylimiter, bufpool *sync.Pool) bool {
+	peer := h.routes.lookup(dstaddr(msg.packet[:msg.len]))
+	if peer == nil || peer == client {
+		return false
+	}
+
+	if !h.allow {
+		bufpool.Put(msg)
+		hairpinmetric.WithLabelValues("denied").Inc()
+		return true
+	}
+
+	// Packets too big for the peer take the router path to be fragmented
+	if !h.enabled || msg.len > peer.mtu {
+		return false
+	}
+
+	// Evaluated once here, the packet doesn't go on to the router
+	if acl.filter(peer, aclIn, msg, serverip, send, limiter, bufpool) {
+		hairpinmetric.WithLabelValues("refused").Inc()
+		return true
+	}
+
+	deliver(peer, msg, bufpool)
+	hairpinmetric.WithLabelValues("hairpin").Inc()
+	return true
+}
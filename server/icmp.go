@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// ICMP types and codes that the server generates
+const (
+	icmpUnreachable = 3  // Destination unreachable
+	icmpHost        = 1  // Host unreachable code
+	icmpFragNeeded  = 4  // Fragmentation needed and DF set code
+	icmpProhibited  = 13 // Communication administratively prohibited code
+
+	icmp6TooBig = 2 // ICMPv6 packet too big
+)
+
+// Limits the replies generated for a destination to one per interval
+// Owned by a single goroutine, so no locking
+// IPv6 destinations are kept apart by their full address
+type replylimiter struct {
+	interval time.Duration
+	last     map[uint32]time.Time
+	last6    map[[16]byte]time.Time
+}
+
+func newreplylimiter(interval time.Duration) *replylimiter {
+	return &replylimiter{
+		interval: interval,
+		last:     make(map[uint32]time.Time),
+		last6:    make(map[[16]byte]time.Time),
+	}
+}
+
+// Check if a reply may be sent to dst now, and record it if so
+func (l *replylimiter) allow(dst uint32) bool {
+	now := time.Now()
+	if last, ok := l.last[dst]; ok && now.Sub(last) < l.interval {
+		return false
+	}
+
+	// Keep the table from growing without bound by reaping expired entries
+	if len(l.last) >= 4096 {
+		for ip, last := range l.last {
+			if now.Sub(last) >= l.interval {
+				delete(l.last, ip)
+			}
+		}
+	}
+
+	l.last[dst] = now
+	return true
+}
+
+// Check if a reply may be sent to the IPv6 dst now, and record it if so
+func (l *replylimiter) allow6(dst [16]byte) bool {
+	now := time.Now()
+	if last, ok := l.last6[dst]; ok && now.Sub(last) < l.interval {
+		return false
+	}
+
+	// Keep the table from growing without bound by reaping expired entries
+	if len(l.last6) >= 4096 {
+		for ip, last := range l.last6 {
+			if now.Sub(last) >= l.interval {
+				delete(l.last6, ip)
+			}
+		}
+	}
+
+	l.last6[dst] = now
+	return true
+}
+
+// Check that an error reply may be generated for an IPv4 packet
+// Never reply to ICMP errors, later fragments, or from/to broadcast and multicast addresses (RFC 1122 3.2.2)
+func replyable(packet []byte) bool {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return false
+	}
+
+	hdrlen := (int(packet[0]) & 0x0F) * 4
+	if len(packet) < hdrlen {
+		return false
+	}
+
+	// Only the first fragment
+	if packet[6]&0x1F != 0 || packet[7] != 0 {
+		return false
+	}
+
+	src := binary.BigEndian.Uint32(packet[12:16])
+	dst := binary.BigEndian.Uint32(packet[16:20])
+	if src == 0 || src>>28 == 0xE || src == 0xFFFFFFFF || dst>>28 == 0xE || dst == 0xFFFFFFFF {
+		return false
+	}
+
+	// ICMP errors (and anything we can't read the type of)
+	if packet[9] == 1 {
+		if len(packet) < hdrlen+1 {
+			return false
+		}
+		switch packet[hdrlen] {
+		case 3, 4, 5, 11, 12:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Refuse a packet with a TCP RST, or otherwise an ICMP unreachable with code sent from serverip
+// The reply is passed to send, and the kind of reply made is returned: rst, icmp, limited or none
+func refuse(packet []byte, code byte, serverip uint32, send func(*message), limiter *replylimiter, bufpool *sync.Pool) string {
+	if !replyable(packet) {
+		return "none"
+	}
+
+	if !limiter.allow(binary.BigEndian.Uint32(packet[12:16])) {
+		return "limited"
+	}
+
+	reply := bufpool.Get().(*message)
+	reply.clr()
+
+	var n int
+	var kind string
+	if packet[9] == 6 {
+		n = tcpreset(reply.packet, packet)
+		kind = "rst"
+	} else {
+		n = icmpunreach(reply.packet, packet, serverip, code, 0)
+		kind = "icmp"
+	}
+
+	if n == 0 {
+		bufpool.Put(reply)
+		return "none"
+	}
+
+	reply.set(n)
+	send(reply)
+	return kind
+}
+
+// Write an IPv4 header for a generated packet to buf
+func ipv4header(buf []byte, src uint32, dst uint32, proto byte, totallen int) {
+	buf[0] = 0x45 // Version 4, 5 word header
+	buf[1] = 0
+	binary.BigEndian.PutUint16(buf[2:], uint16(totallen))
+	binary.BigEndian.PutUint16(buf[4:], 0) // ID
+	binary.BigEndian.PutUint16(buf[6:], 0)
+	buf[8] = 64 // TTL
+	buf[9] = proto
+	binary.BigEndian.PutUint16(buf[10:], 0) // Leave checksum zero for the calculation
+	binary.BigEndian.PutUint32(buf[12:], src)
+	binary.BigEndian.PutUint32(buf[16:], dst)
+	binary.BigEndian.PutUint16(buf[10:], checksum(buf[:20]))
+}
+
+// Build an ICMP destination unreachable reply to packet in buf
+// nexthop is the MTU reported with the fragmentation needed code
+// Returns the length of the reply
+func icmpunreach(buf []byte, packet []byte, src uint32, code byte, nexthop uint16) int {
+	// The ip header plus 8 bytes of the payload (RFC 792)
+	hdrlen := (int(packet[0]) & 0x0F) * 4
+	datalen := hdrlen + 8
+	if datalen > len(packet) {
+		datalen = len(packet)
+	}
+
+	totallen := 20 + 8 + datalen
+	ipv4header(buf, src, binary.BigEndian.Uint32(packet[12:16]), 1, totallen)
+
+	icmp := buf[20:totallen]
+	icmp[0] = icmpUnreachable
+	icmp[1] = code
+	binary.BigEndian.PutUint16(icmp[2:], 0) // Leave checksum zero for the calculation
+	binary.BigEndian.PutUint16(icmp[4:], 0) // Unused
+	binary.BigEndian.PutUint16(icmp[6:], nexthop)
+	copy(icmp[8:], packet[:datalen])
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp))
+
+	return totallen
+}
+
+// Build a TCP RST reply to a TCP packet in buf (RFC 793 3.4)
+// The reset comes from the packet's destination so the sender's stack accepts it
+// Returns the length of the reply, or zero if the packet should not be reset
+func tcpreset(buf []byte, packet []byte) int {
+	hdrlen := (int(packet[0]) & 0x0F) * 4
+	if len(packet) < hdrlen+20 {
+		return 0
+	}
+	tcp := packet[hdrlen:]
+	flags := tcp[13]
+
+	// Never reset a reset
+	if flags&0x04 != 0 {
+		return 0
+	}
+
+	totallen := 20 + 20
+	ipv4header(buf, binary.BigEndian.Uint32(packet[16:20]), binary.BigEndian.Uint32(packet[12:16]), 6, totallen)
+
+	rst := buf[20:totallen]
+	for i := range rst {
+		rst[i] = 0
+	}
+
+	// Swap the ports
+	copy(rst[0:2], tcp[2:4])
+	copy(rst[2:4], tcp[0:2])
+
+	if flags&0x10 != 0 {
+		// <SEQ=SEG.ACK><CTL=RST>
+		copy(rst[4:8], tcp[8:12])
+		rst[13] = 0x04
+	} else {
+		// <SEQ=0><ACK=SEG.SEQ+SEG.LEN><CTL=RST,ACK>
+		seglen := int(binary.BigEndian.Uint16(packet[2:4])) - hdrlen - int(tcp[12]>>4)*4
+		if flags&0x02 != 0 { // SYN
+			seglen++
+		}
+		if flags&0x01 != 0 { // FIN
+			seglen++
+		}
+		binary.BigEndian.PutUint32(rst[8:12], binary.BigEndian.Uint32(tcp[4:8])+uint32(seglen))
+		rst[13] = 0x14
+	}
+
+	rst[12] = 5 << 4 // Data offset
+	binary.BigEndian.PutUint16(rst[16:], tcpchecksum(buf[:totallen]))
+
+	return totallen
+}
+
+// Calculate the TCP checksum of an IPv4 packet with a zeroed checksum field
+func tcpchecksum(packet []byte) uint16 {
+	tcp := packet[(int(packet[0])&0x0F)*4:]
+
+	// Pseudo-header of addresses, protocol and TCP length
+	sum := uint32(6) + uint32(len(tcp))
+	for i := 12; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(packet[i:]))
+	}
+
+	for i := 0; i < len(tcp); i += 2 {
+		sum += uint32(word(tcp, i))
+	}
+
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// Check that an error reply may be generated for an IPv6 packet
+// Never reply to ICMPv6 errors, or to the unspecified or multicast addresses (RFC 4443 2.4)
+func replyable6(packet []byte) bool {
+	if len(packet) < 40 || packet[0]>>4 != 6 {
+		return false
+	}
+
+	src := net.IP(packet[8:24])
+	if src.IsUnspecified() || src.IsMulticast() {
+		return false
+	}
+
+	// ICMPv6 errors have types below 128
+	if packet[6] == 58 && (len(packet) < 41 || packet[40] < 128) {
+		return false
+	}
+
+	return true
+}
+
+// Build an ICMPv6 packet too big reply to an IPv6 packet in buf, reporting mtu (RFC 4443 3.2)
+// The reply comes from the packet's destination, as the tunnel has no router address on the packet's path
+// As much of the packet is quoted as fits in the IPv6 minimum MTU and buf
+// Returns the length of the reply
+func icmp6toobig(buf []byte, packet []byte, mtu int) int {
+	datalen := len(packet)
+	if max := 1280 - 48; datalen > max {
+		datalen = max
+	}
+	if max := len(buf) - 48; datalen > max {
+		datalen = max
+	}
+	totallen := 40 + 8 + datalen
+
+	buf[0] = 0x60 // Version 6, no traffic class or flow label
+	buf[1], buf[2], buf[3] = 0, 0, 0
+	binary.BigEndian.PutUint16(buf[4:], uint16(8+datalen))
+	buf[6] = 58 // ICMPv6
+	buf[7] = 64 // Hop limit
+	copy(buf[8:24], packet[24:40])
+	copy(buf[24:40], packet[8:24])
+
+	icmp := buf[40:totallen]
+	icmp[0] = icmp6TooBig
+	icmp[1] = 0
+	binary.BigEndian.PutUint16(icmp[2:], 0) // Leave checksum zero for the calculation
+	binary.BigEndian.PutUint32(icmp[4:], uint32(mtu))
+	copy(icmp[8:], packet[:datalen])
+	binary.BigEndian.PutUint16(icmp[2:], icmp6checksum(buf[:totallen]))
+
+	return totallen
+}
+
+// Calculate the ICMPv6 checksum of an IPv6 packet without extension headers and with a zeroed checksum field
+func icmp6checksum(packet []byte) uint16 {
+	icmp := packet[40:]
+
+	// Pseudo-header of addresses, upper layer length and next header
+	sum := uint32(58) + uint32(len(icmp))
+	for i := 8; i < 40; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(packet[i:]))
+	}
+
+	for i := 0; i < len(icmp); i += 2 {
+		sum += uint32(word(icmp, i))
+	}
+
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
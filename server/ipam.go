@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/micro/go-micro/v2/config"
+)
+
+// Allocates client tunnel addresses from the address pools
+// The local backend keeps its leases to itself, the shared backend coordinates them with other servers through a shared store
+// Implementations are safe for use by the client handlers, runblock, and the metrics server
+type IPAM interface {
+	// Allocate an address for client from the first pool that selects it
+	// sticky is set when it is the address the identity had last time, or the one reserved for it
+	// Returns a nil ip when there are no addresses to give
+	Allocate(client *Client) (ip net.IP, p *pool, sticky bool)
+
+	// Release the address of a client that disconnected
+	Release(ip net.IP)
+
+	// Reserve ip for the identity name, replacing any address already reserved for it
+	// Fails when ip isn't a host address of a pool, or is in use by or reserved for another identity
+	Reserve(name string, ip net.IP) error
+
+	// Report all of the leases
+	List() Leases
+
+	// Return the addresses of idle leases that expired by now to their pools
+	Expire(now time.Time)
+}
+
+// Make the IPAM backend named by secnet.ipam, local or shared
+func newipam(pools *poolset) IPAM {
+	switch backend := config.Get("secnet", "ipam").String("local"); backend {
+	case "local":
+		return newnetblock(pools)
+
+	case "shared":
+		hostname, _ := os.Hostname()
+		node := config.Get("secnet", "node").String(hostname)
+		path := config.Get("secnet", "sharedstore").String("")
+		if path == "" || node == "" {
+			log.Fatal("server: ipam: the shared backend needs secnet.sharedstore and secnet.node")
+		}
+		return newsharedblock(pools, path, node)
+
+	default:
+		log.Fatalf("server: ipam: unknown secnet.ipam backend %q", backend)
+		return nil
+	}
+}
+
+// Releases the addresses of disconnected clients, and expires idle leases
+// Exits when the state channel is closed
+func runblock(ipam IPAM, subchan chan<- ClientStateSub) {
+	// Channel to receive client state
+	statechan := make(chan ClientState)
+
+	// Subscribe to client state stream
+	subchan <- ClientStateSub{name: "netblock", subchan: statechan}
+
+	// Expire idle leases even when nobody is connecting
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	log.Print("server: netblock: starting main loop")
+	for {
+		select {
+		case state, ok := <-statechan:
+			if !ok {
+				log.Print("server: netblock(term): statechan closed")
+				return
+			}
+
+			if state.transition == Disconnect {
+				ipam.Release(state.client.ip)
+			}
+
+		case now := <-ticker.C:
+			ipam.Expire(now)
+		}
+	}
+}
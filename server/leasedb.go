@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A lease change as written to the lease database
+// Later records for an address replace earlier ones, and a dropped record forgets the address
+type leaserecord struct {
+	IP         string    `json:"ip"`
+	Name       string    `json:"name,omitempty"`
+	Node       string    `json:"node,omitempty"`
+	Active     bool      `json:"active,omitempty"`
+	Expires    time.Time `json:"expires,omitempty"`
+	Reserved   bool      `json:"reserved,omitempty"`
+	Configured bool      `json:"configured,omitempty"`
+	Dropped    bool      `json:"dropped,omitempty"`
+}
+
+// Append-only log of lease changes on disk, so leases survive restarts
+// Each record is a line of json that is synced to disk before the write returns
+// A torn record at the end of the log from a crash is ignored on load
+// The log is compacted to one record per lease on load and when it grows too far past that
+type leasedb struct {
+	path    string
+	file    *os.File
+	records int // Records in the log
+}
+
+// Open the lease database at path, creating it if it doesn't exist
+// Returns the last record of every lease in it
+func openleasedb(path string) (*leasedb, map[uint32]leaserecord, error) {
+	leases := make(map[uint32]leaserecord)
+
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			var rec leaserecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				log.Printf("server: leasedb: ignoring the rest of %s from bad record on line %d: %s", path, line, err)
+				break
+			}
+
+			ip := net.ParseIP(rec.IP).To4()
+			if ip == nil {
+				log.Printf("server: leasedb: ignoring record with bad address %q on line %d", rec.IP, line)
+				continue
+			}
+
+			if rec.Dropped {
+				delete(leases, ip2int(ip))
+			} else {
+				leases[ip2int(ip)] = rec
+			}
+		}
+		file.Close()
+	}
+
+	db := &leasedb{path: path}
+	var recs []leaserecord
+	for _, rec := range leases {
+		recs = append(recs, rec)
+	}
+	if err := db.compact(recs); err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("server: leasedb: loaded %d leases from %s", len(leases), path)
+	return db, leases, nil
+}
+
+// The record of the current state of a lease
+func (l *lease) record() leaserecord {
+	return leaserecord{
+		IP:         int2ip(l.ip).String(),
+		Name:       l.name,
+		Node:       l.node,
+		Active:     l.active,
+		Expires:    l.expires,
+		Reserved:   l.reserved,
+		Configured: l.configured,
+	}
+}
+
+// Append a record for the current state of the lease
+func (d *leasedb) save(l *lease) {
+	d.append(l.record())
+}
+
+// Append a record forgetting the lease's address
+func (d *leasedb) drop(l *lease) {
+	d.append(leaserecord{IP: int2ip(l.ip).String(), Dropped: true})
+}
+
+// Write a record to the log and sync it to disk
+// Failures are logged, the leases in memory stay authoritative until the next compaction
+func (d *leasedb) append(rec leaserecord) {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("server: leasedb: error encoding record: %s", err)
+		return
+	}
+
+	if _, err := d.file.Write(append(buf, '\n')); err != nil {
+		log.Printf("server: leasedb: error writing record: %s", err)
+		return
+	}
+	if err := d.file.Sync(); err != nil {
+		log.Printf("server: leasedb: error syncing record: %s", err)
+	}
+	d.records++
+}
+
+// Check if the log has grown enough past the live leases to compact it
+func (d *leasedb) stale(live int) bool {
+	return d.records > 2*live+1024
+}
+
+// Replace the log with one holding just recs
+// The new log is written and synced beside the old one, then renamed over it, so a crash leaves one or the other
+func (d *leasedb) compact(recs []leaserecord) error {
+	tmppath := d.path + ".tmp"
+	tmp, err := os.OpenFile(tmppath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	wr := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(wr)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := wr.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmppath, d.path); err != nil {
+		return err
+	}
+
+	// Make the rename durable
+	if dir, err := os.Open(filepath.Dir(d.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	file, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if d.file != nil {
+		d.file.Close()
+	}
+	d.file = file
+	d.records = len(recs)
+	return nil
+}
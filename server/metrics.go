@@ -26,6 +26,10 @@ var (
 		Name: "vpn_client_disconnect",
 		Help: "Number of times a client has disconnected",
 	})
+	client_stripemetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vpn_client_stripe_join",
+		Help: "Number of striped connections that joined a client session",
+	})
 	client_failmetric = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "vpn_client_fail",
@@ -42,18 +46,49 @@ var (
 		},
 		[]string{"table"},
 	)
-	contrack_enforcedmetric = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "vpn_client_enforced",
-		Help: "Number of times a client's other connection was terminated for too many connections.",
-	})
+	contrack_enforcedmetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_client_enforced",
+			Help: "Number of session policy outcomes, older sessions displaced, new sessions rejected, sessions allowed alongside others, or sessions kicked through the admin API.",
+		},
+		[]string{"outcome"},
+	)
 
 	//Netblock
 	netblock_usemetric = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "vpn_ip_usage",
-			Help: "Client IP utilisation, free and allocated counts.",
+			Help: "Client IP utilisation of each address pool, free, allocated, idle reserved, and idle leased counts.",
 		},
-		[]string{"table"},
+		[]string{"pool", "table"},
+	)
+	netblock_leasemetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_ip_leases",
+			Help: "Number of address allocations from each address pool, by whether the identity's lease was renewed, its reserved address given, a new address given, or an idle lease reclaimed",
+		},
+		[]string{"pool", "result"},
+	)
+	netblock_exhaustedmetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_ip_exhausted",
+			Help: "Number of clients refused because their address pool had no addresses to give.",
+		},
+		[]string{"pool"},
+	)
+	netblock_utilisationmetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vpn_ip_utilisation",
+			Help: "Fraction of each address pool's addresses that are allocated or reserved, idle leases can be reclaimed so they don't count.",
+		},
+		[]string{"pool"},
+	)
+	netblock_warningmetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vpn_ip_warning",
+			Help: "1 when an address pool's utilisation is at or above the warning threshold, otherwise 0.",
+		},
+		[]string{"pool"},
 	)
 
 	// Router
@@ -73,6 +108,155 @@ var (
 		Name: "vpn_tx_bytes",
 		Help: "Number of bytes sent to clients",
 	})
+	tx_oversizemetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vpn_tx_oversize",
+		Help: "Number of packets dropped for exceeding a client's negotiated MTU",
+	})
+	mss_clampedmetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_mss_clamped",
+			Help: "Number of TCP SYN packets with their MSS clamped to the tunnel MTU",
+		},
+		[]string{"path"},
+	)
+	route_noroutemetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_router_noroute",
+			Help: "Number of packets from the tun with no client route, by the reply sent",
+		},
+		[]string{"reply"},
+	)
+	oversizemetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_oversize_packets",
+			Help: "Number of packets larger than the tunnel MTU, by where they were seen and what was done with them",
+		},
+		[]string{"path", "action"},
+	)
+	route_subnetsmetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "vpn_router_subnets",
+		Help: "Number of client subnets with kernel routes installed",
+	})
+	flood_packetsmetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_router_flood",
+			Help: "Number of broadcast and multicast packets, flooded to clients or dropped by policy",
+		},
+		[]string{"kind", "action"},
+	)
+	flood_groupsmetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "vpn_multicast_groups",
+		Help: "Number of multicast groups with members snooped from client IGMP reports",
+	})
+	hairpinmetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_client_to_client",
+			Help: "Number of packets between clients handled in-process, delivered by hairpin, denied by policy, or refused by the peer's ACL",
+		},
+		[]string{"action"},
+	)
+	// ACL
+	acl_hitsmetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_acl_hits",
+			Help: "Number of packets matched by each ACL rule, and by the default action",
+		},
+		[]string{"rule"},
+	)
+	acl_actionmetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_acl_denied",
+			Help: "Number of packets denied by the ACL, by direction and the reply sent",
+		},
+		[]string{"direction", "reply"},
+	)
+	acl_reloadmetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_acl_reloads",
+			Help: "Number of ACL rule set reloads, loaded or failed",
+		},
+		[]string{"result"},
+	)
+
+	// Client state publisher
+	state_backlogmetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vpn_state_backlog",
+			Help: "Client state changes waiting for each subscriber.",
+		},
+		[]string{"subscriber"},
+	)
+	state_slowmetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_state_slow",
+			Help: "Number of times each subscriber left a client state change waiting for more than 3 seconds.",
+		},
+		[]string{"subscriber"},
+	)
+
+	// Audit
+	audit_entriesmetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_audit_entries",
+			Help: "Number of audit log entries, written, failed to write, or dropped when the queue was full.",
+		},
+		[]string{"result"},
+	)
+
+	// Admin
+	admin_drainingmetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "vpn_server_draining",
+			Help: "1 while the server is draining and refusing new sessions.",
+		},
+	)
+
+	// Rate limits
+	ratelimit_ratemetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vpn_ratelimit_rate",
+			Help: "Current rate limit in bytes per second of identities and groups, zero when unlimited",
+		},
+		[]string{"scope", "name", "direction"},
+	)
+	ratelimit_throttledmetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_ratelimit_throttled_bytes",
+			Help: "Number of bytes delayed (upload) or dropped (download) by rate limits",
+		},
+		[]string{"scope", "name", "direction"},
+	)
+
+	// Client queues
+	queue_dropmetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vpn_queue_drops",
+			Help: "Number of packets to each identity dropped by its queue, for overflowing the byte bound or by CoDel",
+		},
+		[]string{"name", "reason"},
+	)
+	queue_delaymetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vpn_queue_delay_seconds",
+			Help: "Moving average of the time packets to each identity wait in its queue",
+		},
+		[]string{"name"},
+	)
+	queue_bytesmetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vpn_queue_bytes",
+			Help: "Number of bytes waiting in each identity's queue",
+		},
+		[]string{"name"},
+	)
+	queue_sojournmetric = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "vpn_queue_sojourn_seconds",
+			Help:    "Time packets wait in client queues",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		},
+	)
+
 	route_durationmetric = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Name:    "vpn_router_nseconds",
@@ -82,7 +266,7 @@ var (
 	)
 )
 
-func metrics(reportchan chan<- chan<- Connections) {
+func metrics(reportchan chan<- chan<- Connections, ipam IPAM) {
 	log.Print("metrics: starting")
 
 	// Register metrics
@@ -92,6 +276,7 @@ func metrics(reportchan chan<- chan<- Connections) {
 	// Client handler
 	prometheus.MustRegister(client_connectmetric)
 	prometheus.MustRegister(client_disconnectmetric)
+	prometheus.MustRegister(client_stripemetric)
 	prometheus.MustRegister(client_failmetric)
 
 	// Conntrack
@@ -100,14 +285,51 @@ func metrics(reportchan chan<- chan<- Connections) {
 
 	// Netblock
 	prometheus.MustRegister(netblock_usemetric)
+	prometheus.MustRegister(netblock_leasemetric)
+	prometheus.MustRegister(netblock_exhaustedmetric)
+	prometheus.MustRegister(netblock_utilisationmetric)
+	prometheus.MustRegister(netblock_warningmetric)
 
 	// Router
 	prometheus.MustRegister(tx_packetsmetric)
 	prometheus.MustRegister(rx_packetsmetric)
 	prometheus.MustRegister(tx_bytesmetric)
 	prometheus.MustRegister(rx_bytesmetric)
+	prometheus.MustRegister(tx_oversizemetric)
+	prometheus.MustRegister(mss_clampedmetric)
+	prometheus.MustRegister(route_noroutemetric)
+	prometheus.MustRegister(oversizemetric)
+	prometheus.MustRegister(route_subnetsmetric)
+	prometheus.MustRegister(hairpinmetric)
+	prometheus.MustRegister(flood_packetsmetric)
+	prometheus.MustRegister(flood_groupsmetric)
 	prometheus.MustRegister(route_durationmetric)
 
+	// Rate limits
+	prometheus.MustRegister(ratelimit_ratemetric)
+	prometheus.MustRegister(ratelimit_throttledmetric)
+
+	// Client queues
+	prometheus.MustRegister(queue_dropmetric)
+	prometheus.MustRegister(queue_delaymetric)
+	prometheus.MustRegister(queue_bytesmetric)
+	prometheus.MustRegister(queue_sojournmetric)
+
+	// ACL
+	prometheus.MustRegister(acl_hitsmetric)
+	prometheus.MustRegister(acl_actionmetric)
+	prometheus.MustRegister(acl_reloadmetric)
+
+	// Client state publisher
+	prometheus.MustRegister(state_backlogmetric)
+	prometheus.MustRegister(state_slowmetric)
+
+	// Audit
+	prometheus.MustRegister(audit_entriesmetric)
+
+	// Admin
+	prometheus.MustRegister(admin_drainingmetric)
+
 	// Expose the registered metrics via HTTP.
 	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/clients", func(w http.ResponseWriter, req *http.Request) {
@@ -125,7 +347,17 @@ func metrics(reportchan chan<- chan<- Connections) {
 		}
 	})
 
+	http.HandleFunc("/leases", func(w http.ResponseWriter, req *http.Request) {
+		if respbuf, err := json.Marshal(ipam.List()); nil != err {
+			log.Printf("server: netblock: report: error json encoding lease array: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(respbuf)
+		}
+	})
+
 	// TODO: get from config
 	log.Print("metrics: http listen on 9000")
-	log.Fatal(http.ListenAndServe("0.0.0.0:9000", msrv))
+	log.Fatal(http.ListenAndServe("0.0.0.0:9000", nil))
 }
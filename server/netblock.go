@@ -1,48 +1,472 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/v2/config"
 )
 
-func runblock(netblock chan<- net.IP, subchan chan<- ClientStateSub, netip uint32) {
-	// Metrics to track
-	alloccount := netblock_usemetric.WithLabelValues("allocated")
-	freecount := netblock_usemetric.WithLabelValues("free")
+// An address held by a client identity
+// Active while a client of the identity is connected with it, and idle until it expires after that
+type lease struct {
+	name       string
+	ip         uint32
+	pool       *pool
+	node       string // The server the client holding an active lease is connected to
+	active     bool
+	expires    time.Time // When an idle lease returns its address to the pool
+	reserved   bool      // Reserved for the identity, never expires or goes to anyone else
+	configured bool      // Reserved by secnet.reservations rather than at runtime
+}
+
+// A lease as reported by the admin API
+type Lease struct {
+	IP       string    `json:"ip"`
+	Name     string    `json:"name"`
+	Pool     string    `json:"pool"`
+	Node     string    `json:"node,omitempty"`
+	Active   bool      `json:"active"`
+	Reserved bool      `json:"reserved,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+// A list of leases
+type Leases []Lease
+
+// Marshal function to format Lease Expires fields as ISO8601 json strings, empty for active leases
+func (l Lease) MarshalJSON() ([]byte, error) {
+	type Alias Lease
+	expires := ""
+	if !l.Active && !l.Reserved {
+		expires = l.Expires.UTC().Format(time.RFC3339)
+	}
+	return json.Marshal(&struct {
+		Alias
+		Expires string `json:"expires,omitempty"`
+	}{
+		Alias:   (Alias)(l),
+		Expires: expires,
+	})
+}
+
+// The local IPAM backend, and the lease state the shared backend loads from its store for each change
+// Each identity keeps a lease on the last address it was given, and gets it back when it reconnects while the lease is idle
+// Idle leases expire after leasetime and their addresses return to the pool, or are reclaimed early when the pool runs dry
+// Reserved addresses are only ever given to the identity they are reserved for
+// The local backend keeps leases in the lease database when there is one, and restores them from it idle at startup
+type netblock struct {
+	sync.Mutex
+	pools     *poolset
+	node      string // The server allocating, empty for the local backend
+	leasetime time.Duration
+	warning   float64                     // The utilisation of a pool that it is warned about at
+	free      map[*pool][]uint32          // Unleased addresses of each pool, handed out first in first out
+	byname    map[*pool]map[string]*lease // The latest pooled lease of each identity in each pool
+	leases    map[uint32]*lease           // By address
+	reserved  map[string]*lease           // The reserved lease of each identity that has one
+	db        *leasedb                    // Nil when leases aren't persisted
+}
+
+// Make lease state holding just the configured reservations, allocating as node
+// Idle leases last for secnet.leasetime seconds, and pools are warned about when their utilisation reaches secnet.warnthreshold
+// The free lists are empty until fill is called, after any other leases are loaded
+func newblockstate(pools *poolset, node string) *netblock {
+	b := &netblock{
+		pools:     pools,
+		node:      node,
+		leasetime: time.Duration(config.Get("secnet", "leasetime").Int(86400)) * time.Second,
+		warning:   config.Get("secnet", "warnthreshold").Float64(0.9),
+		free:      make(map[*pool][]uint32),
+		byname:    make(map[*pool]map[string]*lease),
+		leases:    make(map[uint32]*lease),
+		reserved:  make(map[string]*lease),
+	}
+	for _, p := range pools.list {
+		b.byname[p] = make(map[string]*lease)
+	}
+
+	for name, addr := range pools.reservations {
+		l := &lease{name: name, ip: addr, pool: pools.poolof(addr), reserved: true, configured: true}
+		b.leases[addr] = l
+		b.reserved[name] = l
+	}
+	return b
+}
+
+// Make the local IPAM backend
+// Leases are persisted to the secnet.leasefile database, unless it is empty
+func newnetblock(pools *poolset) *netblock {
+	b := newblockstate(pools, "")
+
+	if path := config.Get("secnet", "leasefile").String("leases.db"); path != "" {
+		db, records, err := openleasedb(path)
+		if err != nil {
+			log.Fatalf("server: netblock: error opening lease database %s: %s", path, err)
+		}
+		b.db = db
+		log.Printf("server: netblock: restored %d leases", b.load(records, time.Now()))
+
+		// Nobody is connected yet, so leases that were active get a full leasetime to come back
+		b.recover(time.Now())
+	}
+	b.fill()
+
+	log.Printf("server: netblock: starting with %d pools, %d reserved addresses, leases idle for %s", len(pools.list), len(b.reserved), b.leasetime)
+	b.metrics()
+	return b
+}
+
+// Load leases from their records
+// Records of configured reservations only carry whether they are active
+// Leases that expired, no longer fit a pool, or collide with a configured reservation are dropped
+// Returns the number of leases loaded
+func (b *netblock) load(records map[uint32]leaserecord, now time.Time) (loaded int) {
+	for addr, rec := range records {
+		l := &lease{
+			name:     rec.Name,
+			ip:       addr,
+			pool:     b.pools.poolof(addr),
+			node:     rec.Node,
+			active:   rec.Active,
+			expires:  rec.Expires,
+			reserved: rec.Reserved && !rec.Configured,
+		}
+
+		if other, ok := b.leases[addr]; ok {
+			if other.name == rec.Name {
+				other.active, other.node = rec.Active, rec.Node
+				continue
+			}
+			log.Printf("server: netblock: dropping lease on %s for %s, it is reserved for %s", int2ip(addr), rec.Name, other.name)
+			b.forget(l)
+			continue
+		}
+		if l.pool == nil || rec.Name == "" || (!l.active && !l.reserved && now.After(l.expires)) {
+			b.forget(l)
+			continue
+		}
+
+		// The configured reservation of an identity replaces one made at runtime
+		if _, ok := b.reserved[l.name]; ok && l.reserved {
+			l.reserved = false
+			l.expires = now.Add(b.leasetime)
+		}
+
+		if l.reserved {
+			b.reserved[l.name] = l
+		} else if last, ok := b.byname[l.pool][l.name]; !ok || last.expires.Before(l.expires) {
+			// An identity gets back the latest of its leases in the pool
+			b.byname[l.pool][l.name] = l
+		}
+		b.leases[addr] = l
+		loaded++
+	}
+	return loaded
+}
+
+// Idle the active leases of this server's clients, when none of them can be connected
+func (b *netblock) recover(now time.Time) {
+	for _, l := range b.leases {
+		if l.active && l.node == b.node {
+			l.active, l.node = false, ""
+			if !l.reserved {
+				l.expires = now.Add(b.leasetime)
+			}
+			b.persist(l)
+		}
+	}
+}
+
+// Put the addresses without leases on the free lists of their pools
+func (b *netblock) fill() {
+	for _, p := range b.pools.list {
+		b.free[p] = nil
+		for addr := p.first; addr <= p.last; addr++ {
+			if _, ok := b.leases[addr]; !ok {
+				b.free[p] = append(b.free[p], addr)
+			}
+		}
+	}
+}
+
+// Reaps expired leases first, so their addresses can be given out
+func (b *netblock) Allocate(client *Client) (ip net.IP, p *pool, sticky bool) {
+	b.Lock()
+	defer b.Unlock()
+	defer b.metrics()
+
+	now := time.Now()
+	b.reap(now)
+
+	name := client.name
+
+	// The identity's reserved address, further clients of the identity get pooled ones while it is in use
+	if l, ok := b.reserved[name]; ok {
+		if !l.active {
+			l.active, l.node = true, b.node
+			b.persist(l)
+			netblock_leasemetric.WithLabelValues(l.pool.name, "reserved").Inc()
+			log.Printf("server: netblock: allocated reserved ip %s to %s", int2ip(l.ip), name)
+			return int2ip(l.ip), l.pool, true
+		}
+		log.Printf("server: netblock: reserved ip %s for %s is in use, allocating from the pool", int2ip(l.ip), name)
+	}
+
+	p = b.pools.choose(client)
+
+	// The identity's last address, unless another of its clients is using it
+	if l, ok := b.byname[p][name]; ok && !l.active {
+		l.active, l.node = true, b.node
+		b.persist(l)
+		netblock_leasemetric.WithLabelValues(p.name, "renewed").Inc()
+		log.Printf("server: netblock: renewed ip %s for %s", int2ip(l.ip), name)
+		return int2ip(l.ip), p, true
+	}
+
+	var addr uint32
+	if free := b.free[p]; len(free) != 0 {
+		addr = free[0]
+		b.free[p] = free[1:]
+		netblock_leasemetric.WithLabelValues(p.name, "new").Inc()
+	} else {
+		// Reclaim the pool's idle lease closest to expiring
+		var oldest *lease
+		for _, l := range b.leases {
+			if l.pool == p && !l.active && !l.reserved && (oldest == nil || l.expires.Before(oldest.expires)) {
+				oldest = l
+			}
+		}
+		if oldest == nil {
+			netblock_exhaustedmetric.WithLabelValues(p.name).Inc()
+			log.Printf("server: netblock: no addresses left in pool %s for %s", p.name, name)
+			return nil, p, false
+		}
+
+		b.drop(oldest)
+		addr = oldest.ip
+		netblock_leasemetric.WithLabelValues(p.name, "reclaimed").Inc()
+		log.Printf("server: netblock: reclaimed idle lease on %s from %s", int2ip(addr), oldest.name)
+	}
 
-	// Channel to receive client state
-	statechan := make(chan ClientState)
+	l := &lease{name: name, ip: addr, pool: p, node: b.node, active: true}
+	b.leases[addr] = l
+	b.byname[p][name] = l
+	b.persist(l)
+	log.Printf("server: netblock: allocated ip %s from pool %s to %s, %d unleased ips remain", int2ip(addr), p.name, name, len(b.free[p]))
+	return int2ip(addr), p, false
+}
+
+// The released lease idles until it expires, or returns to the pool now when leases don't idle
+func (b *netblock) Release(ip net.IP) {
+	b.Lock()
+	defer b.Unlock()
+	defer b.metrics()
+
+	l, ok := b.leases[ip2int(ip)]
+	if !ok || !l.active {
+		log.Printf("server: netblock: released ip %s that wasn't allocated", ip)
+		return
+	}
 
-	// Subscribe to client state stream
-	subchan <- ClientStateSub{name: "netblock", subchan: statechan}
+	l.active, l.node = false, ""
+	if l.reserved {
+		b.persist(l)
+		log.Printf("server: netblock: reserved ip %s released by %s", ip, l.name)
+		return
+	}
 
-	log.Printf("server: netblock: starting with %d host addresses", cap(netblock))
+	l.expires = time.Now().Add(b.leasetime)
+	if b.leasetime <= 0 {
+		b.drop(l)
+		b.free[l.pool] = append(b.free[l.pool], l.ip)
+	} else {
+		b.persist(l)
+	}
+	log.Printf("server: netblock: recovered ip %s from %s, %d unleased ips remain in pool %s", ip, l.name, len(b.free[l.pool]), l.pool.name)
+}
 
-	// Set the current free count metric
-	freecount.Set(float64(cap(netblock)))
+// An idle lease of another identity on ip is taken over, an active one is an error
+// The identity's own lease on ip becomes the reservation, even while it is active
+func (b *netblock) Reserve(name string, ip net.IP) error {
+	b.Lock()
+	defer b.Unlock()
+	defer b.metrics()
 
-	// Pump the netblock channel full of available addresses
-	// Excluding network, gateway, and broadcast
-	for i := uint32(1); i <= uint32(cap(netblock)); i++ {
-		netblock <- int2ip(netip + i)
+	ip = ip.To4()
+	if ip == nil {
+		return fmt.Errorf("not an ipv4 address")
+	}
+	addr := ip2int(ip)
+	p := b.pools.poolof(addr)
+	if p == nil {
+		return fmt.Errorf("%s is not a client address of any pool", ip)
 	}
 
-	log.Print("server: netblock: starting main loop")
-	for state := range statechan {
-		if state.transition == Connect {
-			// Record metrics
-			alloccount.Inc()
-			freecount.Dec()
+	l, leased := b.leases[addr]
+	if leased && l.name != name && (l.active || l.reserved) {
+		return fmt.Errorf("%s is in use by %s", ip, l.name)
+	}
+	old, ok := b.reserved[name]
+	if ok && old.ip != addr && (old.active || old.configured) {
+		return fmt.Errorf("%s already has %s reserved", name, int2ip(old.ip))
+	}
 
-			log.Printf("server: netblock: allocated ip %s, %d unallocated ips remain", state.client.ip, len(netblock))
-		} else if state.transition == Disconnect {
-			// Record metrics
-			alloccount.Dec()
-			freecount.Inc()
+	// The identity's previous reservation returns to its pool
+	if ok && old.ip != addr {
+		b.drop(old)
+		b.free[old.pool] = append(b.free[old.pool], old.ip)
+	}
 
-			netblock <- state.client.ip
-			log.Printf("server: netblock: recovered ip %s, %d unallocated ips remain", state.client.ip, len(netblock))
+	if !leased {
+		free := b.free[p][:0]
+		for _, other := range b.free[p] {
+			if other != addr {
+				free = append(free, other)
+			}
+		}
+		b.free[p] = free
+	} else if l.name != name {
+		b.drop(l)
+		leased = false
+	}
+
+	if !leased {
+		l = &lease{name: name, ip: addr, pool: p}
+		b.leases[addr] = l
+	} else if b.byname[p][name] == l {
+		delete(b.byname[p], name)
+	}
+
+	l.reserved = true
+	b.reserved[name] = l
+	b.persist(l)
+	log.Printf("server: netblock: reserved ip %s for %s", ip, name)
+	return nil
+}
+
+// Reports the leases in no particular order
+func (b *netblock) List() Leases {
+	b.Lock()
+	defer b.Unlock()
+
+	var leases Leases
+	for _, l := range b.leases {
+		leases = append(leases, Lease{
+			IP:       int2ip(l.ip).String(),
+			Name:     l.name,
+			Pool:     l.pool.name,
+			Node:     l.node,
+			Active:   l.active,
+			Reserved: l.reserved,
+			Expires:  l.expires,
+		})
+	}
+	return leases
+}
+
+// Also refreshes the utilisation metrics
+func (b *netblock) Expire(now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.reap(now)
+	b.metrics()
+}
+
+// Return the addresses of expired idle leases to their pools, must hold the lock
+func (b *netblock) reap(now time.Time) {
+	for addr, l := range b.leases {
+		if !l.active && !l.reserved && now.After(l.expires) {
+			b.drop(l)
+			b.free[l.pool] = append(b.free[l.pool], addr)
+			log.Printf("server: netblock: lease on %s for %s expired", int2ip(addr), l.name)
+		}
+	}
+}
+
+// Forget a lease, must hold the lock
+func (b *netblock) drop(l *lease) {
+	delete(b.leases, l.ip)
+	if b.byname[l.pool][l.name] == l {
+		delete(b.byname[l.pool], l.name)
+	}
+	if b.reserved[l.name] == l {
+		delete(b.reserved, l.name)
+	}
+	b.forget(l)
+}
+
+// Drop a lease from the lease database, must hold the lock
+func (b *netblock) forget(l *lease) {
+	if b.db != nil {
+		b.db.drop(l)
+	}
+}
+
+// Write a lease to the lease database, compacting it when it has grown too large, must hold the lock
+func (b *netblock) persist(l *lease) {
+	if b.db == nil {
+		return
+	}
+	b.db.save(l)
+
+	if b.db.stale(len(b.leases)) {
+		if err := b.db.compact(b.records()); err != nil {
+			log.Printf("server: netblock: error compacting lease database: %s", err)
+		}
+	}
+}
+
+// The records of all of the leases, must hold the lock
+func (b *netblock) records() []leaserecord {
+	var records []leaserecord
+	for _, l := range b.leases {
+		records = append(records, l.record())
+	}
+	return records
+}
+
+// Update the utilisation metrics of each pool, must hold the lock
+func (b *netblock) metrics() {
+	active := make(map[*pool]int)
+	reserved := make(map[*pool]int)
+	leased := make(map[*pool]int)
+	for _, l := range b.leases {
+		switch {
+		case l.active:
+			active[l.pool]++
+		case l.reserved:
+			reserved[l.pool]++
+		default:
+			leased[l.pool]++
+		}
+	}
+
+	for _, p := range b.pools.list {
+		netblock_usemetric.WithLabelValues(p.name, "allocated").Set(float64(active[p]))
+		netblock_usemetric.WithLabelValues(p.name, "reserved").Set(float64(reserved[p]))
+		netblock_usemetric.WithLabelValues(p.name, "leased").Set(float64(leased[p]))
+		netblock_usemetric.WithLabelValues(p.name, "free").Set(float64(len(b.free[p])))
+
+		// Log once as a pool crosses the warning threshold, and again when it drops back below it
+		utilisation := float64(active[p]+reserved[p]) / float64(p.last-p.first+1)
+		netblock_utilisationmetric.WithLabelValues(p.name).Set(utilisation)
+		warn := utilisation >= b.warning
+		if warn {
+			netblock_warningmetric.WithLabelValues(p.name).Set(1)
+		} else {
+			netblock_warningmetric.WithLabelValues(p.name).Set(0)
+		}
+		if warn && !p.warned {
+			log.Printf("server: netblock: pool %s is %.0f%% utilised, at or above the %.0f%% warning threshold", p.name, utilisation*100, b.warning*100)
+		} else if !warn && p.warned {
+			log.Printf("server: netblock: pool %s is back below the warning threshold at %.0f%% utilised", p.name, utilisation*100)
 		}
+		p.warned = warn
 	}
-	log.Print("server: netblock(term): statechan closed")
 }
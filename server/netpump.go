@@ -4,23 +4,32 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/joshperry/govpn/mss"
 	"github.com/songgao/water"
 )
 
 type message struct {
-	buf        [MTU + 4]byte
+	buf        []byte
 	packet     []byte
 	wirepacket []byte
 	len        int
+	queued     time.Time // When the message was pushed onto a client queue
+}
+
+// Make a message with a buffer for packets up to mtu bytes plus the length header
+func newmessage(mtu int) *message {
+	return &message{buf: make([]byte, mtu+4)}
 }
 
 func (msg *message) clr() {
-	msg.len = MTU
-	msg.wirepacket = msg.buf[:MTU+4]
+	msg.len = len(msg.buf) - 4
+	msg.wirepacket = msg.buf
 	msg.packet = msg.wirepacket[4:]
 }
 
@@ -35,21 +44,35 @@ func (msg *message) elen() int {
 	return int(binary.BigEndian.Uint32(msg.wirepacket))
 }
 
+// Set up the message slices from the embedded length
+// Fails if the length is larger than the message buffer
 func (msg *message) eset() error {
 	packetlen := msg.elen()
-	if packetlen > MTU {
+	if packetlen+4 > len(msg.buf) {
 		return errors.New(fmt.Sprintf("connrx(term): packetlen %d MTU too small or lost framing sync", packetlen))
 	}
 
 	if packetlen != msg.len {
 		msg.len = packetlen
 		msg.wirepacket = msg.buf[:msg.len+4]
-		msg.packet = msg.buf[4:]
+		msg.packet = msg.wirepacket[4:]
 	}
 
 	return nil
 }
 
+// A connection that more than one goroutine writes whole frames to
+type lockedconn struct {
+	net.Conn
+	sync.Mutex
+}
+
+func (c *lockedconn) Write(b []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.Conn.Write(b)
+}
+
 type filterfunc func(*message, filterstack) error
 
 type filterstack []filterfunc
@@ -60,7 +83,11 @@ func (stack filterstack) next(msg *message) error {
 
 type messagesender func(*message) error
 
-func connrx(rdr net.Conn, routers chan<- *message, clientip uint32, readerr chan<- bool, wait *sync.WaitGroup, bufpool *sync.Pool) {
+// Packets larger than the client's mtu are fragmented, or answered from serverip with ICMP fragmentation needed when DF is set, at most once per replyinterval
+// Packets for other clients are handled by peers unless it is nil
+// Packets are filtered by the acl on their way out of the client
+// Broadcast and multicast packets are handled by the flood policy, which snoops the client's IGMP reports
+func connrx(rdr net.Conn, tun flowdispatch, client *Client, peers *hairpin, flood *floodpolicy, acl *aclengine, serverip uint32, replyinterval time.Duration, clamp int, readerr chan<- bool, wait *sync.WaitGroup, bufpool *sync.Pool) {
 	// Leave the wait group when the read pump exits
 	defer wait.Done()
 	defer func() {
@@ -70,6 +97,12 @@ func connrx(rdr net.Conn, routers chan<- *message, clientip uint32, readerr chan
 
 	log.Print("connrx: starting")
 
+	clampcount := mss_clampedmetric.WithLabelValues("connrx")
+
+	// Oversized packets are sent on to the tun and any ICMP replies go to the client through it
+	send := tun.send
+	limiter := newreplylimiter(replyinterval)
+
 	// Forever read
 	for {
 		msg := bufpool.Get().(*message)
@@ -81,12 +114,26 @@ func connrx(rdr net.Conn, routers chan<- *message, clientip uint32, readerr chan
 		}
 
 		//log.Print("connrx: waiting")
-		if n, err := rdr.Read(msg.wirepacket[:4]); nil != err {
+		if _, err := io.ReadFull(rdr, msg.wirepacket[:4]); nil != err {
 			fatal("error reading", err)
 			return
-		} else if n < 4 {
-			fatal("", errors.New("short read"))
-			return
+		}
+
+		// Packets that don't fit a message can't be forwarded, but they can still be answered
+		if packetlen := msg.elen(); packetlen > len(msg.buf)-4 && packetlen <= MaxMTU {
+			if err := discard(rdr, msg, packetlen); nil != err {
+				fatal("error while discarding oversize packet", err)
+				return
+			}
+
+			// IPv6 packets are never fragmented on the way
+			if msg.packet[0]>>4 == 6 || msg.packet[6]&0x40 != 0 {
+				fragneeded(msg.packet, client.mtu, serverip, send, limiter, bufpool, "connrx")
+			} else {
+				oversizemetric.WithLabelValues("connrx", "dropped").Inc()
+			}
+			bufpool.Put(msg)
+			continue
 		}
 
 		if err := msg.eset(); nil != err {
@@ -96,49 +143,100 @@ func connrx(rdr net.Conn, routers chan<- *message, clientip uint32, readerr chan
 
 		// This ends when the connection is closed locally or remotely
 		// Read int header
-		if n, err := rdr.Read(msg.packet); nil != err {
+		if _, err := io.ReadFull(rdr, msg.packet); nil != err {
 			// Read failed, pumpexit the handler
 			fatal("error while reading header", err)
 			return
-		} else if n < msg.len {
-			fatal("", errors.New("short read"))
-			return
 		}
 
 		// Grab the packet source ip
-		srcip := binary.BigEndian.Uint32(msg.packet[12:16])
+		srcip := srcaddr(msg.packet[:msg.len])
 
 		//cprintf("received packet %s", spew.Sdump(headers))
 
-		// Drop any packets with a source address different than the one allocated to the client
-		if srcip != clientip {
-			fatal("", errors.New(fmt.Sprintf("dropped bogon %s", int2ip(srcip))))
+		// Drop any packets with a source address the client doesn't own
+		if srcip == nil || !client.owns(srcip) {
+			log.Printf("connrx(drop): bogon %s", net.IP(srcip))
+			bufpool.Put(msg)
+			continue
+		}
+
+		// Filter packets leaving the client
+		if acl.filter(client, aclOut, msg, serverip, send, limiter, bufpool) {
+			continue
 		}
 
-		// Send the packet to the routers
-		routers <- msg
+		// Hold the client to its upload rate, pushing back on its connection
+		shape(client.upload, msg.len)
+
+		// Keep the peer's TCP segments inside the tunnel MTU
+		if clamp != 0 && mss.Clamp(msg.packet, clamp) {
+			clampcount.Inc()
+		}
 
 		// Metrics
 		rx_packetsmetric.Inc()
 		rx_bytesmetric.Add(float64(msg.len))
+		client.traffic.up(msg.len)
+
+		// Packets over the negotiated MTU
+		if msg.len > client.mtu {
+			toobig(msg, client.mtu, serverip, send, send, limiter, bufpool, "connrx")
+			continue
+		}
+
+		// Track the multicast groups the client joins
+		flood.snoop(client, msg.packet[:msg.len])
+
+		// Broadcast and multicast packets go to the clients the policy floods them to, as well as the tun
+		if flood.flood(client, msg, acl, bufpool) {
+			tun.send(msg)
+			continue
+		}
+
+		// Packets for other clients may skip the tun or be refused
+		if peers != nil && peers.forward(client, msg, acl, serverip, send, limiter, bufpool) {
+			continue
+		}
+
+		// Send the packet to the tun queue for its flow
+		tun.send(msg)
 	}
 }
 
-func conntx(messages <-chan *message, conn net.Conn, writeerr chan<- bool, wait *sync.WaitGroup, bufpool *sync.Pool) {
+// Packets for the client are counted in its traffic, whichever of its connections they are written to
+// TCP SYNs to the client are clamped to the MSS of its negotiated MTU
+func conntx(messages <-chan *message, conn net.Conn, client *Client, writeerr chan<- bool, wait *sync.WaitGroup, bufpool *sync.Pool) {
 	defer func() {
 		wait.Done()
 		close(writeerr)
 		log.Print("contx(term): message channel closed")
 	}()
 
+	clamp := client.clampmtu()
+	clampcount := mss_clampedmetric.WithLabelValues("conntx")
+
 	for msg := range messages {
 		//TODO: Any processing on packet from tun adapter
 
+		// The client would lose framing sync on packets larger than its negotiated MTU
+		if msg.len > client.mtu {
+			bufpool.Put(msg)
+			tx_oversizemetric.Inc()
+			continue
+		}
+
+		// Keep TCP segments from the far end inside the client's tunnel MTU
+		if clamp != 0 && mss.Clamp(msg.packet[:msg.len], clamp) {
+			clampcount.Inc()
+		}
+
 		// Write packet
 		n, err := conn.Write(msg.wirepacket)
 		//log.Printf("conntx: wrote %d bytes", n)
 
 		// Put the message back
+		packetlen := msg.len
 		bufpool.Put(msg)
 
 		if nil != err {
@@ -150,12 +248,13 @@ func conntx(messages <-chan *message, conn net.Conn, writeerr chan<- bool, wait
 
 		// Metrics
 		tx_packetsmetric.Inc()
-		tx_bytesmetric.Add(float64(msg.len))
+		tx_bytesmetric.Add(float64(packetlen))
+		client.traffic.down(packetlen)
 	}
 }
 
-// Take messages from the tun queue and put them on the txchan
-func tunrx(tun *water.Interface, txchan chan<- *message, bufpool *sync.Pool) {
+// Take messages from the tun queue and send them to the router for their flow
+func tunrx(tun *water.Interface, routers flowdispatch, bufpool *sync.Pool) {
 	log.Print("tunrx: starting")
 
 	for {
@@ -172,8 +271,8 @@ func tunrx(tun *water.Interface, txchan chan<- *message, bufpool *sync.Pool) {
 
 			msg.set(n)
 
-			// Send the message to the channel
-			txchan <- msg
+			// Send the message to the router for its flow
+			routers.send(msg)
 		}
 	}
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+
+	"github.com/micro/go-micro/v2/config"
+)
+
+// A named range of client addresses, and the identities and groups that get their addresses from it
+// Never changed once the pool set is made
+type pool struct {
+	name       string
+	ipnet      *net.IPNet
+	first      uint32 // The first and last host addresses handed out
+	last       uint32
+	groups     []string
+	identities []string
+	routes     []*net.IPNet // The netblocks of the other pools, which clients in this one route through the tunnel
+	warned     bool         // Utilisation is at or above the warning threshold, guarded by the allocator
+}
+
+// Check if the pool gives addresses to client
+// Pools without selectors give addresses to everyone
+func (p *pool) selects(client *Client) bool {
+	if len(p.groups) == 0 && len(p.identities) == 0 {
+		return true
+	}
+	for _, name := range p.identities {
+		if name == client.name {
+			return true
+		}
+	}
+	for _, group := range p.groups {
+		if client.ingroup(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if addr is one of the pool's host addresses
+func (p *pool) holds(addr uint32) bool {
+	return addr >= p.first && addr <= p.last
+}
+
+// The address pools and the addresses reserved for identities in them, from the config
+type poolset struct {
+	list         []*pool           // In the order they are tried, the server's netblock last
+	reservations map[string]uint32 // Reserved addresses by identity
+}
+
+// Make the pool set of the client addresses of servernet following the server's address, and of the pools in secnet.pools
+// secnet.reservations maps identities to their reserved addresses
+// Invalid or overlapping pools, and reservations outside of the pools or of an address reserved for another identity, are fatal
+func newpoolset(servernet *net.IPNet) *poolset {
+	s := &poolset{reservations: make(map[string]uint32)}
+
+	var pools []struct {
+		Name       string   `json:"name"`
+		Netblock   string   `json:"netblock"`
+		Groups     []string `json:"groups"`
+		Identities []string `json:"identities"`
+	}
+	if err := config.Get("secnet", "pools").Scan(&pools); nil != err {
+		log.Fatalf("server: pools: error reading secnet.pools: %s", err)
+	}
+
+	for _, cfg := range pools {
+		_, ipnet, err := net.ParseCIDR(cfg.Netblock)
+		if err != nil || ipnet.IP.To4() == nil {
+			log.Fatalf("server: pools: pool %q has invalid ipv4 netblock %q", cfg.Name, cfg.Netblock)
+		}
+		if cfg.Name == "" || cfg.Name == "default" {
+			log.Fatalf("server: pools: pool for %s needs a name other than %q", ipnet, cfg.Name)
+		}
+
+		// Every address but the network and broadcast addresses
+		network := ip2int(ipnet.IP)
+		broadcast := network | ^binary.BigEndian.Uint32(ipnet.Mask)
+		if broadcast-network < 2 {
+			log.Fatalf("server: pools: pool %s netblock %s has no host addresses", cfg.Name, ipnet)
+		}
+		s.add(&pool{
+			name:       cfg.Name,
+			ipnet:      ipnet,
+			first:      network + 1,
+			last:       broadcast - 1,
+			groups:     cfg.Groups,
+			identities: cfg.Identities,
+		})
+	}
+
+	// Everyone else gets addresses from the server's netblock, excluding the network, server, and broadcast addresses
+	network := ip2int(servernet.IP.Mask(servernet.Mask))
+	s.add(&pool{
+		name:  "default",
+		ipnet: &net.IPNet{IP: servernet.IP.Mask(servernet.Mask), Mask: servernet.Mask},
+		first: ip2int(servernet.IP) + 1,
+		last:  (network | ^binary.BigEndian.Uint32(servernet.Mask)) - 1,
+	})
+
+	for _, p := range s.list {
+		for _, other := range s.list {
+			if other != p {
+				p.routes = append(p.routes, other.ipnet)
+			}
+		}
+	}
+
+	reserved := make(map[uint32]string)
+	for name, ipstr := range config.Get("secnet", "reservations").StringMap(map[string]string{}) {
+		ip := net.ParseIP(ipstr).To4()
+		if ip == nil {
+			log.Fatalf("server: pools: reservation for %s has invalid ipv4 address %q", name, ipstr)
+		}
+
+		addr := ip2int(ip)
+		if s.poolof(addr) == nil {
+			log.Fatalf("server: pools: reservation for %s of %s is outside of the client addresses of every pool", name, ip)
+		}
+		if other, ok := reserved[addr]; ok {
+			log.Fatalf("server: pools: reservation for %s of %s collides with the reservation for %s", name, ip, other)
+		}
+		reserved[addr] = name
+		s.reservations[name] = addr
+	}
+
+	for _, p := range s.list {
+		log.Printf("server: pools: pool %s has %d host addresses in %s", p.name, p.last-p.first+1, p.ipnet)
+	}
+	return s
+}
+
+// Add a pool to be tried after those already added, its netblock must not overlap theirs
+func (s *poolset) add(p *pool) {
+	for _, other := range s.list {
+		if other.name == p.name {
+			log.Fatalf("server: pools: more than one pool named %s", p.name)
+		}
+		if other.ipnet.Contains(p.ipnet.IP) || p.ipnet.Contains(other.ipnet.IP) {
+			log.Fatalf("server: pools: pool %s netblock %s overlaps pool %s netblock %s", p.name, p.ipnet, other.name, other.ipnet)
+		}
+	}
+	s.list = append(s.list, p)
+}
+
+// The first pool that selects client, the server's netblock selects everyone
+func (s *poolset) choose(client *Client) *pool {
+	for _, p := range s.list {
+		if p.selects(client) {
+			return p
+		}
+	}
+	return s.list[len(s.list)-1]
+}
+
+// Find the pool that addr is a host address of, nil if there is none
+func (s *poolset) poolof(addr uint32) *pool {
+	for _, p := range s.list {
+		if p.holds(addr) {
+			return p
+		}
+	}
+	return nil
+}
+
+// The netblocks of all of the pools
+func (s *poolset) nets() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, p := range s.list {
+		nets = append(nets, p.ipnet)
+	}
+	return nets
+}
+
+// The netblocks of the pools besides the server's, which need routes to the tun
+func (s *poolset) extranets() []*net.IPNet {
+	return s.list[len(s.list)-1].routes
+}
@@ -5,13 +5,17 @@ import (
 	"time"
 )
 
+// How long a subscriber may leave a state waiting before it is reported as slow
+const stateslow = 3 * time.Second
+
 type ClientStateSub struct {
 	name    string
 	subchan chan<- ClientState
 }
 
 func publishstate(statechan <-chan ClientState, subchan <-chan ClientStateSub) {
-	var subchans []ClientStateSub
+	// The channel feeding each subscriber's backlog
+	var backlogs []chan<- ClientState
 
 	log.Print("statepublisher: starting")
 
@@ -25,20 +29,65 @@ func publishstate(statechan <-chan ClientState, subchan <-chan ClientStateSub) {
 			}
 
 			log.Printf("statepublisher: got %d message to publish", state.transition)
-			for _, sub := range subchans {
-				select {
-				case sub.subchan <- state:
-					log.Printf("statepublisher: published to %s", sub.name)
-				case <-time.After(3 * time.Second):
-					log.Printf("statepublisher(panic): timed out sending to %s", sub.name)
-					panic("timed out sending")
-				}
+			for _, backlog := range backlogs {
+				backlog <- state
 			}
 
 		case sub := <-subchan:
 			log.Printf("statepublisher: subscriber %s", sub.name)
-			subchans = append(subchans, sub)
-			defer close(sub.subchan)
+			backlog := make(chan ClientState)
+			backlogs = append(backlogs, backlog)
+			defer close(backlog)
+			go substate(sub, backlog)
 		}
 	}
 }
+
+// Buffer the states published to a subscriber, so a slow subscriber never holds up the publisher or the others
+// A subscriber that leaves a state waiting longer than stateslow is logged and counted, but gets every state in order
+// Closes the subscriber's channel once in is closed and the backlog delivered
+func substate(sub ClientStateSub, in <-chan ClientState) {
+	defer close(sub.subchan)
+
+	backlog := state_backlogmetric.WithLabelValues(sub.name)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var states []ClientState
+	var waiting time.Time // Since the subscriber last took a state, or the backlog started
+	var reported bool     // The subscriber was reported as slow since it last took a state
+	for in != nil || len(states) != 0 {
+		var out chan<- ClientState
+		var next ClientState
+		if len(states) != 0 {
+			out, next = sub.subchan, states[0]
+		}
+
+		select {
+		case state, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			if len(states) == 0 {
+				waiting = time.Now()
+			}
+			states = append(states, state)
+
+		case out <- next:
+			log.Printf("statepublisher: published to %s", sub.name)
+			states[0] = ClientState{}
+			states = states[1:]
+			waiting, reported = time.Now(), false
+
+		case <-ticker.C:
+			if len(states) != 0 && !reported && time.Since(waiting) > stateslow {
+				log.Printf("statepublisher: %s is slow, %d states waiting", sub.name, len(states))
+				state_slowmetric.WithLabelValues(sub.name).Inc()
+				reported = true
+			}
+		}
+
+		backlog.Set(float64(len(states)))
+	}
+}
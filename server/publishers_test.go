@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A subscriber that stops reading holds up neither the publisher nor the other subscribers
+func TestPublishSlowSubscriber(t *testing.T) {
+	statechan := make(chan ClientState)
+	subchan := make(chan ClientStateSub)
+	go publishstate(statechan, subchan)
+
+	stuck := make(chan ClientState)
+	fast := make(chan ClientState)
+	subchan <- ClientStateSub{name: "stuck", subchan: stuck}
+	subchan <- ClientStateSub{name: "fast", subchan: fast}
+
+	got := make(chan []uint64)
+	go func() {
+		var ids []uint64
+		for state := range fast {
+			ids = append(ids, state.client.id)
+		}
+		got <- ids
+	}()
+
+	const count = 100
+	for i := 1; i <= count; i++ {
+		select {
+		case statechan <- ClientState{client: &Client{id: uint64(i)}, transition: Connect}:
+		case <-time.After(time.Second):
+			t.Fatalf("publisher blocked on state %d", i)
+		}
+	}
+	close(statechan)
+
+	select {
+	case ids := <-got:
+		if len(ids) != count {
+			t.Fatalf("fast subscriber got %d states, want %d", len(ids), count)
+		}
+		for i, id := range ids {
+			if id != uint64(i+1) {
+				t.Fatalf("fast subscriber got state %d at %d", id, i)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fast subscriber's channel wasn't closed")
+	}
+
+	// The stuck subscriber still gets every state once it reads
+	for i := 1; i <= count; i++ {
+		if state := <-stuck; state.client.id != uint64(i) {
+			t.Fatalf("stuck subscriber got state %d at %d", state.client.id, i)
+		}
+	}
+	if _, ok := <-stuck; ok {
+		t.Fatal("stuck subscriber's channel wasn't closed")
+	}
+}
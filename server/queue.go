@@ -0,0 +1,252 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/joshperry/govpn/priority"
+	"github.com/micro/go-micro/v2/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A byte-bounded packet queue with a FIFO per priority class, each managed with CoDel (RFC 8289)
+// Safe for any number of producers, with a single consumer
+// Replaces a buffered channel so it can be bounded by bytes, timestamp packets, and be pushed to after closing
+type pktqueue struct {
+	sync.Mutex
+	bands  [priority.Classes]codelband // Guarded by the lock
+	bytes  int                         // Guarded by the lock
+	closed bool                        // Guarded by the lock
+	sched  *priority.Scheduler         // Guarded by the lock
+	ready  chan bool                   // Signalled when a message is pushed
+	done   chan bool                   // Closed when the queue is closed
+
+	classify  *priority.Classifier
+	limit     int           // Byte bound of the queue
+	maxpacket int           // Never drop while less than a packet is queued in a band
+	target    time.Duration // Acceptable standing queue delay
+	interval  time.Duration // Time the delay must stay above target before dropping
+	ewma      float64       // Moving average of the sojourn time in seconds, guarded by the lock
+
+	name      string // The client identity the metrics are labelled with
+	bufpool   *sync.Pool
+	overflow  prometheus.Counter // Drops for exceeding the byte bound
+	codeldrop prometheus.Counter // Drops by CoDel for standing delay
+	delay     prometheus.Gauge   // Moving average of packet sojourn time
+	depth     prometheus.Gauge   // Bytes queued
+}
+
+// The FIFO of a priority class and its CoDel state
+type codelband struct {
+	msgs       []*message
+	bytes      int
+	firstabove time.Time
+	dropnext   time.Time
+	count      int
+	lastcount  int
+	dropping   bool
+}
+
+// Number of open queues labelling their metrics with each identity
+// Several clients of an identity share its series, which are deleted when the last of their queues closes
+var queuelabels = struct {
+	sync.Mutex
+	users map[string]int
+}{users: make(map[string]int)}
+
+// Make a queue for the named client, with limits from the queue section of the config
+func newpktqueue(name string, maxpacket int, bufpool *sync.Pool) *pktqueue {
+	queuelabels.Lock()
+	queuelabels.users[name]++
+	queuelabels.Unlock()
+
+	return &pktqueue{
+		ready:     make(chan bool, 1),
+		done:      make(chan bool),
+		sched:     priority.NewScheduler(maxpacket),
+		classify:  priority.NewClassifier(),
+		limit:     config.Get("queue", "bytes").Int(262144),
+		maxpacket: maxpacket,
+		target:    time.Duration(config.Get("queue", "target").Int(5)) * time.Millisecond,
+		interval:  time.Duration(config.Get("queue", "interval").Int(100)) * time.Millisecond,
+		name:      name,
+		bufpool:   bufpool,
+		overflow:  queue_dropmetric.WithLabelValues(name, "overflow"),
+		codeldrop: queue_dropmetric.WithLabelValues(name, "codel"),
+		delay:     queue_delaymetric.WithLabelValues(name),
+		depth:     queue_bytesmetric.WithLabelValues(name),
+	}
+}
+
+// Add a message to the tail of the queue for its priority class
+// Returns false if it was not queued because the queue is full or closed, the caller keeps the message
+func (q *pktqueue) push(msg *message) bool {
+	q.Lock()
+	if q.closed {
+		q.Unlock()
+		return false
+	}
+	if q.bytes+msg.len > q.limit {
+		q.Unlock()
+		q.overflow.Inc()
+		return false
+	}
+
+	band := &q.bands[q.classify.Classify(msg.packet[:msg.len])]
+	msg.queued = time.Now()
+	band.msgs = append(band.msgs, msg)
+	band.bytes += msg.len
+	q.bytes += msg.len
+	q.Unlock()
+
+	// Wake the consumer
+	select {
+	case q.ready <- true:
+	default:
+	}
+	return true
+}
+
+// Take the head message off a band, must hold the lock
+// okdrop is set when the head has been delayed long enough for CoDel to drop it
+func (q *pktqueue) dodequeue(band *codelband, now time.Time) (msg *message, okdrop bool) {
+	if len(band.msgs) == 0 {
+		band.firstabove = time.Time{}
+		return nil, false
+	}
+
+	msg = band.msgs[0]
+	band.msgs[0] = nil
+	band.msgs = band.msgs[1:]
+	band.bytes -= msg.len
+	q.bytes -= msg.len
+
+	sojourn := now.Sub(msg.queued)
+	queue_sojournmetric.Observe(sojourn.Seconds())
+
+	if sojourn < q.target || band.bytes <= q.maxpacket {
+		band.firstabove = time.Time{}
+	} else if band.firstabove.IsZero() {
+		band.firstabove = now.Add(q.interval)
+	} else if !now.Before(band.firstabove) {
+		okdrop = true
+	}
+
+	return msg, okdrop
+}
+
+// The next drop time from CoDel's control law
+func (q *pktqueue) controllaw(t time.Time, count int) time.Time {
+	return t.Add(time.Duration(float64(q.interval) / math.Sqrt(float64(count))))
+}
+
+// Take the next message to send off a band, dropping ones that have been waiting too long, must hold the lock
+func (q *pktqueue) codelpop(band *codelband, now time.Time) *message {
+	msg, okdrop := q.dodequeue(band, now)
+
+	if band.dropping {
+		if !okdrop {
+			band.dropping = false
+		}
+		for band.dropping && !now.Before(band.dropnext) {
+			q.drop(msg)
+			band.count++
+			if msg, okdrop = q.dodequeue(band, now); !okdrop {
+				band.dropping = false
+			} else {
+				band.dropnext = q.controllaw(band.dropnext, band.count)
+			}
+		}
+	} else if okdrop {
+		q.drop(msg)
+		msg, _ = q.dodequeue(band, now)
+		band.dropping = true
+
+		// Start near the last drop rate if we were dropping recently
+		delta := band.count - band.lastcount
+		band.count = 1
+		if delta > 1 && now.Sub(band.dropnext) < 16*q.interval {
+			band.count = delta
+		}
+		band.dropnext = q.controllaw(now, band.count)
+		band.lastcount = band.count
+	}
+
+	return msg
+}
+
+// Take the next message to send off the queue, from the priority class the scheduler picks
+// Returns nil when the queue is empty
+func (q *pktqueue) pop() *message {
+	q.Lock()
+	defer q.Unlock()
+
+	now := time.Now()
+	var msg *message
+	for msg == nil {
+		var heads [priority.Classes]int
+		for class := range q.bands {
+			if len(q.bands[class].msgs) != 0 {
+				heads[class] = q.bands[class].msgs[0].len
+			}
+		}
+
+		class := q.sched.Pick(heads)
+		if class < 0 {
+			break
+		}
+
+		// CoDel may drop every message in the band, then pick again
+		msg = q.codelpop(&q.bands[class], now)
+	}
+
+	if msg != nil {
+		// Exponential moving average of the delay for the metrics
+		q.ewma = 0.9*q.ewma + 0.1*now.Sub(msg.queued).Seconds()
+		q.delay.Set(q.ewma)
+	}
+	q.depth.Set(float64(q.bytes))
+
+	return msg
+}
+
+// Drop a message taken off the queue by CoDel, must hold the lock
+func (q *pktqueue) drop(msg *message) {
+	if msg != nil {
+		q.bufpool.Put(msg)
+		q.codeldrop.Inc()
+	}
+}
+
+// Close the queue, returning any queued messages to the pool
+// Later pushes fail, and done is closed to release the consumer
+// The identity's metric series are deleted if no other queue of it is open
+func (q *pktqueue) close() {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	for class := range q.bands {
+		for _, msg := range q.bands[class].msgs {
+			q.bufpool.Put(msg)
+		}
+		q.bands[class] = codelband{}
+	}
+	q.bytes = 0
+	q.depth.Set(0)
+	close(q.done)
+
+	queuelabels.Lock()
+	defer queuelabels.Unlock()
+	if queuelabels.users[q.name]--; queuelabels.users[q.name] == 0 {
+		delete(queuelabels.users, q.name)
+		queue_dropmetric.DeleteLabelValues(q.name, "overflow")
+		queue_dropmetric.DeleteLabelValues(q.name, "codel")
+		queue_delaymetric.DeleteLabelValues(q.name)
+		queue_bytesmetric.DeleteLabelValues(q.name)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/micro/go-micro/v2/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A token bucket rate limiter counted in bytes
+// Safe for use by the several pumps and routers that carry a client's packets
+type tokenbucket struct {
+	sync.Mutex
+	rate      float64 // Bytes per second, zero for unlimited
+	burst     float64 // Largest number of tokens the bucket holds
+	tokens    float64
+	last      time.Time
+	throttled prometheus.Counter // Bytes delayed or dropped by this bucket
+	limit     prometheus.Gauge   // The current rate
+}
+
+// Limits a rate can be configured with, in bytes per second
+type RateLimit struct {
+	Upload   float64 `json:"upload"`   // From the client, zero for unlimited
+	Download float64 `json:"download"` // To the client, zero for unlimited
+}
+
+// Make a bucket for a scope, name and direction with an initial rate
+func newtokenbucket(scope string, name string, direction string, rate float64) *tokenbucket {
+	b := &tokenbucket{
+		last:      time.Now(),
+		throttled: ratelimit_throttledmetric.WithLabelValues(scope, name, direction),
+		limit:     ratelimit_ratemetric.WithLabelValues(scope, name, direction),
+	}
+	b.setrate(rate)
+	b.tokens = b.burst
+	return b
+}
+
+// Change the rate of the bucket, zero removes the limit
+// The burst is a quarter second of the rate, but never less than 64KiB
+func (b *tokenbucket) setrate(rate float64) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.rate = rate
+	b.burst = rate / 4
+	if b.burst < 65536 {
+		b.burst = 65536
+	}
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.limit.Set(rate)
+}
+
+// The current rate of the bucket
+func (b *tokenbucket) getrate() float64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.rate
+}
+
+// Add the tokens earned since the last refill, must hold the lock
+func (b *tokenbucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Take n tokens, going into debt if there aren't enough
+// Returns how long to wait before sending to stay within the rate
+func (b *tokenbucket) reserve(n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rate == 0 {
+		return 0
+	}
+
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	b.throttled.Add(float64(n))
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Take n tokens only if they are all available
+func (b *tokenbucket) allow(n int) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rate == 0 {
+		return true
+	}
+
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		b.throttled.Add(float64(n))
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Give back n tokens taken by allow
+func (b *tokenbucket) refund(n int) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rate != 0 {
+		b.tokens += float64(n)
+	}
+}
+
+// Shape a message from the client, waiting until every bucket has the tokens for it
+// Blocking the pump pushes back on the client through its TCP connection
+func shape(buckets []*tokenbucket, n int) {
+	var wait time.Duration
+	for _, b := range buckets {
+		if w := b.reserve(n); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Police a message to the client, true if every bucket has the tokens for it
+func police(buckets []*tokenbucket, n int) bool {
+	for i, b := range buckets {
+		if !b.allow(n) {
+			for _, taken := range buckets[:i] {
+				taken.refund(n)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// The upload and download buckets of an identity or group
+type bucketpair struct {
+	upload   *tokenbucket
+	download *tokenbucket
+	users    int  // connected clients of an identity using the buckets
+	pinned   bool // configured or set at runtime, kept while nobody uses them
+}
+
+// Registry of the rate limit buckets for identities and groups
+// Configured buckets, and those set at runtime, live for the life of the server so that changes apply to connected clients
+// Identities on the default limits get buckets that are dropped with their metrics when their last client goes
+// Group buckets are shared by all the connected members of the group
+type ratelimits struct {
+	sync.Mutex
+	clients map[string]*bucketpair
+	groups  map[string]*bucketpair
+}
+
+// Make the registry, reading the configured limits
+func newratelimits() *ratelimits {
+	r := &ratelimits{
+		clients: make(map[string]*bucketpair),
+		groups:  make(map[string]*bucketpair),
+	}
+
+	for scope, table := range map[string]map[string]*bucketpair{"clients": r.clients, "groups": r.groups} {
+		var limits map[string]RateLimit
+		if err := config.Get("ratelimit", scope).Scan(&limits); nil != err {
+			log.Printf("server: ratelimit: failed reading %s limits: %s", scope, err)
+			continue
+		}
+
+		for name, limit := range limits {
+			table[name] = newbucketpair(scope, name, limit)
+			table[name].pinned = true
+		}
+	}
+
+	return r
+}
+
+func newbucketpair(scope string, name string, limit RateLimit) *bucketpair {
+	return &bucketpair{
+		upload:   newtokenbucket(scope, name, "upload", limit.Upload),
+		download: newtokenbucket(scope, name, "download", limit.Download),
+	}
+}
+
+// Get the upload and download buckets that apply to a client
+// Identities without configured limits get the ratelimit.default limits
+func (r *ratelimits) buckets(client *Client) (upload []*tokenbucket, download []*tokenbucket) {
+	r.Lock()
+	defer r.Unlock()
+
+	pair, ok := r.clients[client.name]
+	if !ok {
+		var limit RateLimit
+		config.Get("ratelimit", "default").Scan(&limit)
+		pair = newbucketpair("clients", client.name, limit)
+		r.clients[client.name] = pair
+	}
+	pair.users++
+	upload = append(upload, pair.upload)
+	download = append(download, pair.download)
+
+	for _, group := range client.groups {
+		if pair, ok := r.groups[group]; ok {
+			upload = append(upload, pair.upload)
+			download = append(download, pair.download)
+		}
+	}
+
+	return
+}
+
+// Let go of the buckets a client got from buckets, when it disconnects or fails to connect
+// An identity's default buckets and their metric series are deleted once none of its clients use them
+func (r *ratelimits) release(client *Client) {
+	r.Lock()
+	defer r.Unlock()
+
+	pair, ok := r.clients[client.name]
+	if !ok {
+		return
+	}
+
+	pair.users--
+	if pair.users > 0 || pair.pinned {
+		return
+	}
+
+	delete(r.clients, client.name)
+	for _, direction := range []string{"upload", "download"} {
+		ratelimit_throttledmetric.DeleteLabelValues("clients", client.name, direction)
+		ratelimit_ratemetric.DeleteLabelValues("clients", client.name, direction)
+	}
+}
+
+// Change the limits of an identity or group
+// Creates the group buckets if needed, though only clients connecting after that share them
+func (r *ratelimits) set(scope string, name string, limit RateLimit) {
+	r.Lock()
+	defer r.Unlock()
+
+	table := r.clients
+	if scope == "groups" {
+		table = r.groups
+	}
+
+	if pair, ok := table[name]; ok {
+		pair.upload.setrate(limit.Upload)
+		pair.download.setrate(limit.Download)
+		pair.pinned = true
+	} else {
+		table[name] = newbucketpair(scope, name, limit)
+		table[name].pinned = true
+	}
+}
+
+// Report the current limits of all identities and groups
+func (r *ratelimits) report() map[string]map[string]RateLimit {
+	r.Lock()
+	defer r.Unlock()
+
+	report := map[string]map[string]RateLimit{
+		"clients": make(map[string]RateLimit),
+		"groups":  make(map[string]RateLimit),
+	}
+	for scope, table := range map[string]map[string]*bucketpair{"clients": r.clients, "groups": r.groups} {
+		for name, pair := range table {
+			report[scope][name] = RateLimit{
+				Upload:   pair.upload.getrate(),
+				Download: pair.download.getrate(),
+			}
+		}
+	}
+	return report
+}
+
+// Admin API handler for the rate limits
+// GET /admin/ratelimits reports all limits
+// PUT /admin/ratelimits/clients/<name> or /admin/ratelimits/groups/<name> with a json RateLimit body changes one
+func (r *ratelimits) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/ratelimits"), "/"), "/")
+
+	switch {
+	case req.Method == http.MethodGet && path[0] == "":
+		if respbuf, err := json.Marshal(r.report()); nil != err {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(respbuf)
+		}
+
+	case req.Method == http.MethodPut && len(path) == 2 && (path[0] == "clients" || path[0] == "groups"):
+		var limit RateLimit
+		if err := json.NewDecoder(req.Body).Decode(&limit); nil != err {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if limit.Upload < 0 || limit.Download < 0 {
+			http.Error(w, "rates must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("server: ratelimit: setting %s %s to %+v", path[0], path[1], limit)
+		r.set(path[0], path[1], limit)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// A node in the binary trie of the route table
+// Each level down the trie consumes one bit of the address
+// Nodes are never changed once they are in a table, updates copy the path to the changed node
+type routenode struct {
+	child  [2]*routenode
+	client *Client // The client serving the prefix ending at this node, if any
+}
+
+// Immutable longest-prefix-match table of the clients serving addresses and subnets
+// Keys are the big-endian address bytes, and a prefix length in bits
+// Updates return a new table sharing the unchanged nodes with the old one, so readers of the old table are undisturbed
+type routetable struct {
+	root *routenode
+}
+
+// Get the bit of addr at position i, counting from the most significant
+func addrbit(addr []byte, i int) int {
+	return int(addr[i/8]>>(7-uint(i%8))) & 1
+}
+
+// Copy the node with the route for the prefix below it set to client
+func (n *routenode) with(prefix []byte, bits int, depth int, client *Client) *routenode {
+	node := &routenode{}
+	if n != nil {
+		*node = *n
+	}
+
+	if depth == bits {
+		node.client = client
+	} else {
+		b := addrbit(prefix, depth)
+		node.child[b] = node.child[b].with(prefix, bits, depth+1, client)
+	}
+	return node
+}
+
+// Copy the node without the route for the prefix below it if it is served by client
+// Nodes left empty are pruned to nil
+// Returns the node unchanged and false if there was no such route
+func (n *routenode) without(prefix []byte, bits int, depth int, client *Client) (*routenode, bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	node := *n
+	if depth == bits {
+		if n.client != client {
+			return n, false
+		}
+		node.client = nil
+	} else {
+		b := addrbit(prefix, depth)
+		child, ok := n.child[b].without(prefix, bits, depth+1, client)
+		if !ok {
+			return n, false
+		}
+		node.child[b] = child
+	}
+
+	if node.client == nil && node.child[0] == nil && node.child[1] == nil {
+		return nil, true
+	}
+	return &node, true
+}
+
+// A table with the prefix of bits length routed to client, replacing any existing route for it
+func (t *routetable) insert(prefix []byte, bits int, client *Client) *routetable {
+	return &routetable{root: t.root.with(prefix, bits, 0, client)}
+}
+
+// A table without the route for the prefix of bits length if it is served by client
+// Returns the same table and false if there was no such route
+func (t *routetable) remove(prefix []byte, bits int, client *Client) (*routetable, bool) {
+	root, ok := t.root.without(prefix, bits, 0, client)
+	if !ok {
+		return t, false
+	}
+	return &routetable{root: root}, true
+}
+
+// Find the client serving the longest prefix that matches addr
+func (t *routetable) lookup(addr []byte) *Client {
+	var found *Client
+	node := t.root
+	for i := 0; node != nil; i++ {
+		if node.client != nil {
+			found = node.client
+		}
+		if i == len(addr)*8 {
+			break
+		}
+		node = node.child[addrbit(addr, i)]
+	}
+	return found
+}
+
+// The IPv4 and IPv6 route tables and the connected clients, swapped together
+type routetables struct {
+	v4      *routetable
+	v6      *routetable
+	clients []*Client // Never changed once swapped in, updates copy it
+}
+
+// Tables with the prefix of bits length routed to client in the table for its family
+func (t routetables) insert(prefix []byte, bits int, client *Client) routetables {
+	if len(prefix) == 16 {
+		t.v6 = t.v6.insert(prefix, bits, client)
+	} else {
+		t.v4 = t.v4.insert(prefix, bits, client)
+	}
+	return t
+}
+
+// Tables without the route for the prefix of bits length if it is served by client
+// Returns false if there was no such route
+func (t routetables) remove(prefix []byte, bits int, client *Client) (routetables, bool) {
+	var ok bool
+	if len(prefix) == 16 {
+		t.v6, ok = t.v6.remove(prefix, bits, client)
+	} else {
+		t.v4, ok = t.v4.remove(prefix, bits, client)
+	}
+	return t, ok
+}
+
+// Find the client serving the longest prefix that matches a 4 or 16 byte addr
+func (t routetables) lookup(addr []byte) *Client {
+	if len(addr) == 16 {
+		return t.v6.lookup(addr)
+	}
+	return t.v4.lookup(addr)
+}
+
+// The route tables shared by all of the routers and pumps
+// Readers load the current tables without locking, routeupdates swaps in new ones once per client state change
+type sharedroutes struct {
+	tables atomic.Value // routetables
+	done   chan bool    // Closed when routeupdates exits
+}
+
+func newsharedroutes() *sharedroutes {
+	r := &sharedroutes{done: make(chan bool)}
+	r.tables.Store(routetables{v4: &routetable{}, v6: &routetable{}})
+	return r
+}
+
+// Find the client serving the longest prefix that matches a 4 or 16 byte addr in the current tables
+func (r *sharedroutes) lookup(addr []byte) *Client {
+	return r.tables.Load().(routetables).lookup(addr)
+}
+
+// Keeps the shared route tables updated from client state events
+// A client's tunnel addresses and the subnets it serves are routed to it
+// Exits when the state channel is closed, closing routes.done
+func routeupdates(subchan chan<- ClientStateSub, routes *sharedroutes) {
+	defer func() {
+		close(routes.done)
+		log.Print("server: routeupdates(term): statechan closed")
+	}()
+
+	// Channel to receive client state
+	statechan := make(chan ClientState)
+
+	// Subscribe to client state stream
+	subchan <- ClientStateSub{name: "routes", subchan: statechan}
+
+	// The clients serving each subnet, the latest to connect is routed to
+	owners := make(subnetowners)
+
+	for state := range statechan {
+		tables := routes.tables.Load().(routetables)
+
+		if state.transition == Connect {
+			log.Printf("server: routeupdates: got client connect %s %s-%#x", state.client.ip, state.client.name, state.client.id)
+			tables = tables.insert(state.client.ip.To4(), 32, state.client)
+			// Capped so the append copies rather than writing into the slice readers may hold
+			tables.clients = append(tables.clients[:len(tables.clients):len(tables.clients)], state.client)
+			if state.client.ip6 != nil {
+				tables = tables.insert(state.client.ip6, 128, state.client)
+			}
+			for _, subnet := range state.client.subnets {
+				bits, _ := subnet.Mask.Size()
+				tables = tables.insert(routekey(subnet.IP), bits, state.client)
+				owners.add(subnet, state.client)
+			}
+		} else if state.transition == Disconnect {
+			log.Printf("server: routeupdates: got client disconnect %s %s-%#x", state.client.ip, state.client.name, state.client.id)
+			// Once the disconnect message is recieved, the client handler has exited
+			var ok bool
+			if tables, ok = tables.remove(state.client.ip.To4(), 32, state.client); !ok {
+				// Didn't find a connection in the routes for this client... shouldn't happen
+				log.Printf("server: routeupdates(perm): close no open connection %s %s-%#x", state.client.ip, state.client.name, state.client.id)
+				panic("close no open connection")
+			}
+			if state.client.ip6 != nil {
+				tables, _ = tables.remove(state.client.ip6, 128, state.client)
+			}
+
+			clients := make([]*Client, 0, len(tables.clients))
+			for _, other := range tables.clients {
+				if other != state.client {
+					clients = append(clients, other)
+				}
+			}
+			tables.clients = clients
+
+			// Subnets taken over by a newer client stay with it, others go back to the client that served them before
+			for _, subnet := range state.client.subnets {
+				serving := owners.serving(subnet)
+				owners.drop(subnet, state.client)
+				if serving != state.client {
+					continue
+				}
+
+				bits, _ := subnet.Mask.Size()
+				if next := owners.serving(subnet); next != nil {
+					log.Printf("server: routeupdates: subnet %s back to %s-%#x", subnet, next.name, next.id)
+					tables = tables.insert(routekey(subnet.IP), bits, next)
+				} else {
+					tables, _ = tables.remove(routekey(subnet.IP), bits, state.client)
+				}
+			}
+		} else {
+			log.Printf("server: routeupdates(perm): unhandled client transition state: %d", state.transition)
+			panic("unhandled client transition state")
+		}
+
+		routes.tables.Store(tables)
+	}
+}
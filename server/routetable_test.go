@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// A subnet taken over by a newer client goes back to the older one when the newer one disconnects
+func TestRouteSubnetFallback(t *testing.T) {
+	statechan := make(chan ClientState)
+	subchan := make(chan ClientStateSub)
+	go publishstate(statechan, subchan)
+
+	// Relayed to the publisher, so the subscription is in before any state is published
+	routes := newsharedroutes()
+	relay := make(chan ClientStateSub)
+	go routeupdates(relay, routes)
+	subchan <- <-relay
+
+	_, subnet, _ := net.ParseCIDR("192.168.10.0/24")
+	a := &Client{id: 1, name: "a", ip: net.IPv4(10, 8, 0, 2), subnets: []*net.IPNet{subnet}}
+	b := &Client{id: 2, name: "b", ip: net.IPv4(10, 8, 0, 3), subnets: []*net.IPNet{subnet}}
+	addr := net.IPv4(192, 168, 10, 1).To4()
+
+	// Where the subnet is routed after each state
+	states := []struct {
+		state ClientState
+		want  *Client
+	}{
+		{ClientState{client: a, transition: Connect}, a},
+		{ClientState{client: b, transition: Connect}, b},
+		{ClientState{client: b, transition: Disconnect}, a},
+		{ClientState{client: b, transition: Connect}, b},
+		{ClientState{client: a, transition: Disconnect}, b},
+		{ClientState{client: b, transition: Disconnect}, nil},
+	}
+	var last *Client
+	for i, step := range states {
+		statechan <- step.state
+
+		// A state that shouldn't move the route is given time to wrongly do so
+		if step.want == last {
+			time.Sleep(20 * time.Millisecond)
+		}
+		last = step.want
+
+		deadline := time.Now().Add(time.Second)
+		for routes.lookup(addr) != step.want && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := routes.lookup(addr); got != step.want {
+			t.Fatalf("step %d: subnet routed to %v, want %v", i, got, step.want)
+		}
+	}
+
+	close(statechan)
+	<-routes.done
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
@@ -21,7 +22,10 @@ import (
 )
 
 const (
-	MTU = 1400
+	DefaultMTU = 1400  // Tunnel MTU when none is configured
+	MinMTU     = 576   // Smallest datagram every IPv4 host must accept
+	MaxMTU     = 65535 // Largest packet an IPv4 header can describe
+	IPv6MinMTU = 1280  // Smallest link MTU IPv6 allows, tunnels below it are IPv4 only
 )
 
 /**
@@ -89,10 +93,32 @@ func main() {
 	}
 	tlsconfig.BuildNameToCertificate()
 
+	// The largest tunnel MTU the server supports, clients negotiate down from it
+	mtu := config.Get("tun", "mtu").Int(DefaultMTU)
+	if mtu < MinMTU || mtu > MaxMTU {
+		log.Fatalf("server: tun mtu %d must be between %d and %d", mtu, MinMTU, MaxMTU)
+	}
+
 	// Parse the server address block
 	servernet, _ := netlink.ParseAddr(config.Get("secnet", "netblock").String("192.168.0.1/21"))
 	servernet.IP = int2ip(ip2int(servernet.IP.Mask(servernet.Mask)) + 1) // Set IP to first in the network
 
+	// Parse the optional IPv6 prefix for dual-stack tunnels
+	var servernet6 *netlink.Addr
+	if prefix := config.Get("secnet", "netblock6").String(""); prefix != "" {
+		servernet6, err = netlink.ParseAddr(prefix)
+		if nil != err || servernet6.IP.To4() != nil {
+			log.Fatalf("server: secnet netblock6 %q is not an IPv6 prefix", prefix)
+		}
+		if ones, _ := servernet6.Mask.Size(); ones > 96 {
+			log.Fatalf("server: secnet netblock6 %q must be /96 or larger", prefix)
+		}
+		if mtu < IPv6MinMTU {
+			log.Fatalf("server: tun mtu %d is below the IPv6 minimum %d", mtu, IPv6MinMTU)
+		}
+		servernet6.IP = addr6(servernet6.IP.Mask(servernet6.Mask), 1) // Set IP to first in the network
+	}
+
 	// Create tun interface
 	tunconfig := water.Config{DeviceType: water.TUN, PlatformSpecificParams: water.PlatformSpecificParams{MultiQueue: true}}
 	tunconfig.Name = config.Get("tun", "name").String("tun_govpn")
@@ -106,11 +132,20 @@ func main() {
 	nlhand, _ := netlink.NewHandle()
 	tunlink, _ := netlink.LinkByName(tunconfig.Name)
 	netlink.AddrAdd(tunlink, servernet)
-	nlhand.LinkSetMTU(tunlink, MTU)
-	nlhand.LinkSetUp(tunlink)
+	nlhand.LinkSetMTU(tunlink, mtu)
+
+	// Enable ipv6 on the tun interface only for dual-stack tunnels
+	var servernet6net *net.IPNet
+	if servernet6 != nil {
+		log.Printf("server: setting TUN adapter IPv6 address to %s", servernet6.IP)
+		sysctl.Set(fmt.Sprintf("net.ipv6.conf.%s.disable_ipv6", tunconfig.Name), "0")
+		netlink.AddrAdd(tunlink, servernet6)
+		servernet6net = servernet6.IPNet
+	} else {
+		sysctl.Set(fmt.Sprintf("net.ipv6.conf.%s.disable_ipv6", tunconfig.Name), "1")
+	}
 
-	// Disable ipv6 on tun interface
-	err = sysctl.Set("net.ipv6.conf.tun_govpn.disable_ipv6", "1")
+	nlhand.LinkSetUp(tunlink)
 
 	// Listen for clients
 	listener, err := tls.Listen(
@@ -127,20 +162,20 @@ func main() {
 	}
 	log.Printf("server: listening on %s", listener.Addr().String())
 
-	// Create pool of messages
+	// Create pool of messages large enough for any negotiated MTU
 	bufpool := sync.Pool{
 		New: func() interface{} {
-			return &message{}
+			return newmessage(mtu)
 		},
 	}
 
 	// Create an instance of the VPN server service
 	// Run it 5 times with the active listener to accept connections, tun channels for tun comms, and server network info
 	service := NewService()
-	go service.Serve(listener, iface, &bufpool, servernet.IPNet)
+	go service.Serve(listener, iface, &bufpool, servernet.IPNet, servernet6net, mtu)
 
 	// Handle SIGINT and SIGTERM
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	// Block waiting for a signal
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"log"
-	"math"
 	"net"
 	"sync"
 	"time"
@@ -32,11 +31,24 @@ func NewService() *Service {
 
 // Represents a tracked connection
 type Connection struct {
+	ID       string    `json:"id"` // the session id, for the admin API
 	Time     time.Time `json:"time"`
 	Name     string    `json:"name"`
+	Groups   []string  `json:"groups,omitempty"`
 	IP       string    `json:"ip"`
+	IP6      string    `json:"ip6,omitempty"`
 	PublicIP string    `json:"publicip"`
+	Pool     string    `json:"pool"`
+	Sticky   bool      `json:"sticky"` // got the address its identity had last time
+	MTU      int       `json:"mtu"`
+	Subnets  []string  `json:"subnets,omitempty"`
 	Pending  bool      `json:"pending"`
+
+	// Traffic of the session, up from the client and down to it
+	UpPackets   uint64 `json:"uppackets"`
+	UpBytes     uint64 `json:"upbytes"`
+	DownPackets uint64 `json:"downpackets"`
+	DownBytes   uint64 `json:"downbytes"`
 }
 
 // A list of connections!
@@ -58,7 +70,9 @@ func (c Connection) MarshalJSON() ([]byte, error) {
 // Stop listening if anything is received on the done channel.
 // tuntx: channel to write packets from the client to the tun adapter
 // tunrx: channel to read packets for the clients from the tun adapter
-func (s *Service) Serve(listener net.Listener, tun *water.Interface, bufpool *sync.Pool, servernet *net.IPNet) {
+// servernet6: the IPv6 prefix of dual-stack tunnels, nil when they are IPv4 only
+// mtu: the largest tunnel MTU a client may negotiate
+func (s *Service) Serve(listener net.Listener, tun *water.Interface, bufpool *sync.Pool, servernet *net.IPNet, servernet6 *net.IPNet, mtu int) {
 	defer func() {
 		s.shutdownGroup.Done()
 		// Close the listener when the server stops
@@ -69,29 +83,61 @@ func (s *Service) Serve(listener net.Listener, tun *water.Interface, bufpool *sy
 	// A channel for subscribing the client state stream
 	statesub := make(chan ClientStateSub)
 
-	// A channel for messages exiting via the tun interface
-	tuntxchan := make(chan *message)
-	defer close(tuntxchan)
+	// The number of tun queues, each with a reader and writer
+	tunqueues := config.Get("tun", "queues").Int(8)
+	if tunqueues < 1 {
+		log.Fatalf("server: tun.queues %d must be at least 1", tunqueues)
+	}
+
+	// Channels for messages exiting via each tun queue, dispatched by flow to keep flows in order
+	tuntxchan := newflowdispatch(tunqueues)
+	defer tuntxchan.close()
+
+	// Channels for the packet routers, dispatched by flow to keep flows in order
+	routercount := config.Get("router", "count").Int(4)
+	if routercount < 1 {
+		log.Fatalf("server: router.count %d must be at least 1", routercount)
+	}
+	routers := newflowdispatch(routercount)
+
+	// Packet filter rules for the pumps and routers
+	// Reloaded with the config by aclwatch, which exits if the config can't be watched
+	acl := newaclengine()
+	go aclwatch(acl)
+
+	// How often the routers may answer each sender of unroutable packets
+	replyinterval := time.Duration(config.Get("router", "replyinterval").Int(1000)) * time.Millisecond
+
+	// The route table shared by the routers and pumps
+	// Updated from the client state stream, exits when the state channel is closed
+	routes := newsharedroutes()
+	go routeupdates(statesub, routes)
+
+	// The address pools, the server's netblock and any others
+	pools := newpoolset(servernet)
+
+	// Allocates client addresses from the pools, alone or with other servers
+	ipam := newipam(pools)
 
-	// A channel for the packet routers
-	routers := make(chan *message)
+	// Policy for broadcast and multicast packets
+	flood := newfloodpolicy(routes, pools.nets())
+	go floodupdates(statesub, flood)
 
 	// Start up multiple routers
-	for range [4]int{} {
+	for _, rxchan := range routers {
 		// Routes packets from the tun adapter to the appropriate client
-		// Keeps the route info updated from the client state chan
-		// Exits when state channel is closed
+		// Exits when the route table stops being updated
 		s.shutdownGroup.Add(1)
-		go route(routers, tuntxchan, statesub, bufpool, s.shutdownGroup)
+		go route(rxchan, tuntxchan, routes, flood, acl, ip2int(servernet.IP), replyinterval, bufpool, s.shutdownGroup)
 	}
 
-	// Producer that reads packets off of the tun interface and delivers them to the router channel
+	// Producer that reads packets off of the tun interface and delivers them to the routers
 	go tunrx(tun, routers, bufpool)
-	// Consumer that reads packets off the tuntxchan and puts them on the tun interface
-	go tuntx(tuntxchan, tun, bufpool)
+	// Consumer that reads packets off its tuntxchan and puts them on the tun interface
+	go tuntx(tuntxchan[0], tun, bufpool)
 
 	// Start up multiple readers/writers with separate queues
-	for range [7]int{} {
+	for _, txchan := range tuntxchan[1:] {
 		tunconfig := water.Config{DeviceType: water.TUN, PlatformSpecificParams: water.PlatformSpecificParams{MultiQueue: true}}
 		tunconfig.Name = config.Get("tun", "name").String("tun_govpn")
 		if tun, err := water.New(tunconfig); nil != err {
@@ -100,27 +146,52 @@ func (s *Service) Serve(listener net.Listener, tun *water.Interface, bufpool *sy
 			defer tun.Close()
 
 			go tunrx(tun, routers, bufpool)
-			go tuntx(tuntxchan, tun, bufpool)
+			go tuntx(txchan, tun, bufpool)
 		}
 	}
 
-	// Calculate netblock info
-	netmasklen, networksize := servernet.Mask.Size()
-	hostcount := uint32(math.Pow(2, float64(networksize-netmasklen)))
+	// Releases the addresses of disconnected clients and expires idle leases
+	// Exits when the state channel is closed
+	go runblock(ipam, statesub)
 
-	// Implements a channel that delivers unused IP addresses when read
-	// And returns IPs to the pool when a client disconnects
-	// Set the buffer size to the host count - 3 (network address, server address, and broadcast address)
-	// Exits when netblockstate is closed
-	netblock := make(chan net.IP, hostcount-3)
-	go runblock(netblock, statesub, ip2int(servernet.IP))
+	// Installs kernel routes for the subnets that clients serve
+	// Exits when the state channel is closed
+	go kernroutes(statesub, config.Get("tun", "name").String("tun_govpn"), pools.extranets())
+
+	// Policy for packets between clients, only consulted when it does something
+	var peers *hairpin
+	hairpinon := config.Get("router", "hairpin").Bool(false)
+	clienttoclient := config.Get("router", "clienttoclient").Bool(true)
+	if hairpinon || !clienttoclient {
+		peers = &hairpin{routes: routes, enabled: hairpinon, allow: clienttoclient}
+	}
+
+	// Per-client and per-group rate limits, adjustable through the admin API
+	limits := newratelimits()
 
 	// Channel to request contrack reports
 	reportchan := make(chan chan<- Connections)
 
+	// Channel to look up the client owning a session token
+	sessionchan := make(chan SessionReq)
+	admitchan := make(chan AdmitReq)
+
+	// Channel to disconnect sessions from the admin API
+	disconnectchan := make(chan DisconnectReq)
+
+	// Identities temporarily refused connections through the admin API
+	blocks := newblocklist()
+
+	// Refuses new sessions while the server is drained through the admin API
+	drain := &drainstate{}
+
 	// Track client connection lifetimes for reporting and enforcement
 	// Exits when contrackstate channel is closed
-	go contrack(statesub, reportchan)
+	go contrack(statesub, reportchan, sessionchan, admitchan, disconnectchan)
+
+	// Record client connects and disconnects in the audit log, when there is one
+	// Exits when the state channel is closed
+	go audit(statesub)
 
 	// Channel to send client connection state changes to
 	clientstate := make(chan ClientState)
@@ -139,7 +210,10 @@ func (s *Service) Serve(listener net.Listener, tun *water.Interface, bufpool *sy
 	go acceptor(listener, connchan, s.shutdownGroup)
 
 	// Start metrics http server
-	go metrics(reportchan)
+	go metrics(reportchan, ipam)
+
+	// Start the admin API server, only ever served behind TLS client auth
+	go adminlisten(config.Get("admin", "listen").String("127.0.0.1:9443"), &adminapi{reportchan: reportchan, disconnectchan: disconnectchan, blocks: blocks, drain: drain, ipam: ipam, limits: limits})
 
 	// Forever select on the done channel, and the client connection handler channel
 	for {
@@ -166,7 +240,7 @@ func (s *Service) Serve(listener net.Listener, tun *water.Interface, bufpool *sy
 			log.Printf("server: %s connected", conn.RemoteAddr())
 			// Add a client to the waitgroup, and handle it in a goroutine
 			s.clientGroup.Add(1)
-			go s.serve(conn, tuntxchan, clientstate, bufpool, netblock)
+			go s.serve(conn, tuntxchan, clientstate, bufpool, ipam, sessionchan, admitchan, blocks, drain, peers, flood, acl, limits, ip2int(servernet.IP), replyinterval, servernet6, mtu)
 
 			acceptedmetric.Inc()
 		}
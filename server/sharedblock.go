@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The shared IPAM backend, for servers behind one load balancer sharing the client netblock
+// The leases of every server are kept in a json store on a filesystem they share
+// Each change takes an exclusive lock on the store's lock file, loads the leases, makes the change, and writes them back,
+// so no two servers ever hand out the same address
+// Reads take a shared lock and write nothing
+// The store carries a generation counted up by each write, the leases last loaded or written are kept,
+// and only loaded again when the store's generation shows another server has written it since
+// Active leases carry the node of the server they were allocated by, which idles them when it restarts
+type sharedblock struct {
+	sync.Mutex // Serializes this server's use of the cached leases, the lock file serializes the servers
+	pools      *poolset
+	path       string    // The json store, locked through path.lock
+	node       string    // This server's name in the store
+	state      *netblock // The leases as of generation, nil when they must be loaded
+	generation uint64    // The generation of the store the leases were loaded from or written to, 0 before it exists
+}
+
+// The json store of the shared backend
+type sharedstore struct {
+	Generation uint64          `json:"generation"`
+	Leases     json.RawMessage `json:"leases"` // []leaserecord, only decoded when the generation changed
+}
+
+// Make the shared backend for the store at path, for the server node
+// The leases this node held before a restart are idled, since none of its clients can be connected
+func newsharedblock(pools *poolset, path string, node string) *sharedblock {
+	s := &sharedblock{pools: pools, path: path, node: node}
+
+	if err := s.update(func(b *netblock) { b.recover(time.Now()) }); err != nil {
+		log.Fatalf("server: sharedblock: error opening shared store %s: %s", path, err)
+	}
+
+	log.Printf("server: sharedblock: starting as node %s with shared store %s", node, path)
+	return s
+}
+
+// Run change on the leases of the store while holding its lock exclusively, then write them back
+func (s *sharedblock) update(change func(b *netblock)) error {
+	return s.locked(syscall.LOCK_EX, func(b *netblock) error {
+		change(b)
+
+		b.Lock()
+		defer b.Unlock()
+		return s.write(b.records())
+	})
+}
+
+// Run view on the leases of the store while holding its lock shared
+func (s *sharedblock) read(view func(b *netblock)) error {
+	return s.locked(syscall.LOCK_SH, func(b *netblock) error {
+		view(b)
+		return nil
+	})
+}
+
+// Run f on the current leases of the store while holding its lock in mode
+// The cached leases are dropped when f fails, since they may no longer match the store
+func (s *sharedblock) locked(mode int, f func(b *netblock) error) error {
+	s.Lock()
+	defer s.Unlock()
+
+	lockfile, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lockfile.Close()
+
+	// Released when the lock file is closed
+	if err := syscall.Flock(int(lockfile.Fd()), mode); err != nil {
+		return err
+	}
+
+	if err := s.load(); err != nil {
+		s.state = nil
+		return err
+	}
+	if err := f(s.state); err != nil {
+		s.state = nil
+		return err
+	}
+	return nil
+}
+
+// Load the leases of the store, unless it is the generation they were last loaded from or written to, must hold both locks
+func (s *sharedblock) load() error {
+	buf, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var store sharedstore
+	if len(buf) != 0 && buf[0] == '[' {
+		// A store from before generations, just the leases
+		store.Leases = buf
+	} else if len(buf) != 0 {
+		if err := json.Unmarshal(buf, &store); err != nil {
+			return err
+		}
+	}
+	if s.state != nil && store.Generation == s.generation {
+		return nil
+	}
+
+	records := make(map[uint32]leaserecord)
+	if len(store.Leases) != 0 {
+		var list []leaserecord
+		if err := json.Unmarshal(store.Leases, &list); err != nil {
+			return err
+		}
+		for _, rec := range list {
+			if ip := net.ParseIP(rec.IP).To4(); ip != nil {
+				records[ip2int(ip)] = rec
+			}
+		}
+	}
+
+	b := newblockstate(s.pools, s.node)
+	b.load(records, time.Now())
+	b.fill()
+	s.state, s.generation = b, store.Generation
+	return nil
+}
+
+// Replace the store with recs, as the next generation
+// The new store is written and synced beside the old one, then renamed over it, so a crash leaves one or the other
+func (s *sharedblock) write(recs []leaserecord) error {
+	leases, err := json.Marshal(recs)
+	if err != nil {
+		return err
+	}
+	generation := s.generation + 1
+	buf, err := json.Marshal(sharedstore{Generation: generation, Leases: leases})
+	if err != nil {
+		return err
+	}
+
+	tmppath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmppath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmppath, s.path); err != nil {
+		return err
+	}
+	s.generation = generation
+
+	// Make the rename durable
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// Failing to reach the store refuses the client like an exhausted pool
+func (s *sharedblock) Allocate(client *Client) (ip net.IP, p *pool, sticky bool) {
+	if err := s.update(func(b *netblock) { ip, p, sticky = b.Allocate(client) }); err != nil {
+		log.Printf("server: sharedblock: error allocating for %s: %s", client.name, err)
+		return nil, s.pools.choose(client), false
+	}
+	return ip, p, sticky
+}
+
+// Any server may release an address, it needn't be the one that allocated it
+func (s *sharedblock) Release(ip net.IP) {
+	if err := s.update(func(b *netblock) { b.Release(ip) }); err != nil {
+		log.Printf("server: sharedblock: error releasing %s: %s", ip, err)
+	}
+}
+
+// The reservation is seen by every server sharing the store
+func (s *sharedblock) Reserve(name string, ip net.IP) error {
+	var rerr error
+	if err := s.update(func(b *netblock) { rerr = b.Reserve(name, ip) }); err != nil {
+		return err
+	}
+	return rerr
+}
+
+// Includes the leases of every server sharing the store
+func (s *sharedblock) List() Leases {
+	var leases Leases
+	if err := s.read(func(b *netblock) { leases = b.List() }); err != nil {
+		log.Printf("server: sharedblock: error listing leases: %s", err)
+	}
+	return leases
+}
+
+// Each server expires the idle leases of them all
+func (s *sharedblock) Expire(now time.Time) {
+	if err := s.update(func(b *netblock) { b.Expire(now) }); err != nil {
+		log.Printf("server: sharedblock: error expiring leases: %s", err)
+	}
+}
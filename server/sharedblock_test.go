@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// A pool set of just the server's netblock, as each server would make from the same config
+func testpools(t *testing.T, cidr string) *poolset {
+	t.Helper()
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := ip2int(ipnet.IP)
+	pools := &poolset{reservations: make(map[string]uint32)}
+	pools.add(&pool{
+		name:  "default",
+		ipnet: ipnet,
+		first: ip2int(ip.To4()) + 1,
+		last:  (network | ^ip2int(net.IP(ipnet.Mask))) - 1,
+	})
+	return pools
+}
+
+// Two servers sharing a store never give the same address to different clients
+func TestSharedblockConcurrentAllocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sharedblock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leases.json")
+
+	nodes := []*sharedblock{
+		newsharedblock(testpools(t, "10.8.0.1/26"), path, "a"),
+		newsharedblock(testpools(t, "10.8.0.1/26"), path, "b"),
+	}
+
+	const perNode = 25
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	given := make(map[string]string)
+	for n, node := range nodes {
+		for i := 0; i < perNode; i++ {
+			wg.Add(1)
+			go func(node *sharedblock, name string) {
+				defer wg.Done()
+				ip, _, _ := node.Allocate(&Client{name: name})
+				if ip == nil {
+					t.Errorf("no address for %s", name)
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				if other, ok := given[ip.String()]; ok {
+					t.Errorf("%s given to both %s and %s", ip, other, name)
+				}
+				given[ip.String()] = name
+			}(node, fmt.Sprintf("client%d-%d", n, i))
+		}
+	}
+	wg.Wait()
+
+	if len(given) != len(nodes)*perNode {
+		t.Fatalf("gave %d addresses, want %d", len(given), len(nodes)*perNode)
+	}
+
+	// Each server sees the leases of both, without rewriting the store to read them
+	before := storegeneration(t, path)
+	for _, node := range nodes {
+		leases := node.List()
+		if len(leases) != len(given) {
+			t.Errorf("node %s lists %d leases, want %d", node.node, len(leases), len(given))
+		}
+		for _, l := range leases {
+			if given[l.IP] != l.Name || !l.Active {
+				t.Errorf("node %s lists %+v, want an active lease for %s", node.node, l, given[l.IP])
+			}
+		}
+	}
+	if after := storegeneration(t, path); after != before {
+		t.Errorf("listing leases rewrote the store from generation %d to %d", before, after)
+	}
+}
+
+// The generation of the store at path
+func storegeneration(t *testing.T, path string) uint64 {
+	t.Helper()
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var store sharedstore
+	if err := json.Unmarshal(buf, &store); err != nil {
+		t.Fatal(err)
+	}
+	return store.Generation
+}
+
+// A store replaced by another server is loaded again, even when it looks like the same file
+func TestSharedblockStaleStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sharedblock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leases.json")
+
+	node := newsharedblock(testpools(t, "10.8.0.1/26"), path, "a")
+	if leases := node.List(); len(leases) != 0 {
+		t.Fatalf("new store lists %d leases", len(leases))
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewritten in place with a lease of another server, keeping its inode and mtime
+	recs, err := json.Marshal([]leaserecord{{IP: "10.8.0.5", Name: "other", Node: "b", Active: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := json.Marshal(sharedstore{Generation: storegeneration(t, path) + 1, Leases: recs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, stat.ModTime(), stat.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	leases := node.List()
+	if len(leases) != 1 || leases[0].Name != "other" {
+		t.Errorf("node lists %+v, want the lease of other", leases)
+	}
+}
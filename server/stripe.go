@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/joshperry/govpn/flow"
+)
+
+// The queue length of each striped connection's tx channel
+// Kept short so packets wait in the client's managed queue rather than here
+const stripequeue = 4
+
+// A request to find the Client that owns a session token
+// Answered by contrack with nil when no connected client holds the token
+type SessionReq struct {
+	token string
+	resp  chan<- *Client
+}
+
+// Spreads the packets routed to a client across all of its striped connections
+// Each flow is pinned to a single connection by its hash to keep per-flow ordering
+// Connections are added on client.join and removed on client.leave
+// Waits for a connection to take each packet, so a slow connection backs packets up into client.tx where CoDel manages them
+// Exits when client.tx is closed by contrack, closing all of the stripe channels and client.gone
+func stripe(client *Client, primary chan *message, bufpool *sync.Pool) {
+	defer func() {
+		close(client.gone)
+		log.Printf("server: stripe(term): %s-%#x", client.name, client.id)
+	}()
+
+	stripes := []chan *message{primary}
+
+	leave := func(tx chan *message) {
+		for i, other := range stripes {
+			if other == tx {
+				stripes = append(stripes[:i], stripes[i+1:]...)
+				close(tx)
+				break
+			}
+		}
+		log.Printf("server: stripe: %s-%#x left, %d connections", client.name, client.id, len(stripes))
+	}
+
+	// Hand a message to the connection its flow hashes to
+	// Returns false when the queue closed while waiting
+	send := func(msg *message) bool {
+		hash := flow.Hash(msg.packet[:msg.len])
+		for {
+			// Connections that die leave while we wait, so pick again after one does
+			select {
+			case stripes[hash%uint32(len(stripes))] <- msg:
+				return true
+			case tx := <-client.leave:
+				leave(tx)
+			case <-client.tx.done:
+				bufpool.Put(msg)
+				return false
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-client.tx.ready:
+			for msg := client.tx.pop(); msg != nil; msg = client.tx.pop() {
+				if !send(msg) {
+					break
+				}
+			}
+
+		case <-client.tx.done:
+			for _, tx := range stripes {
+				close(tx)
+			}
+			return
+
+		case tx := <-client.join:
+			stripes = append(stripes, tx)
+			log.Printf("server: stripe: %s-%#x joined, %d connections", client.name, client.id, len(stripes))
+
+		case tx := <-client.leave:
+			leave(tx)
+		}
+	}
+}
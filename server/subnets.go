@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/micro/go-micro/v2/config"
+	"github.com/vishvananda/netlink"
+)
+
+// Work out the subnets a client identity serves as a gateway
+// Subnets in subnets.static are always served, advertised subnets only when they fall inside subnets.allowed
+// Returns the served subnets, and the advertised subnets that were refused
+func clientsubnets(name string, advertised []string) ([]*net.IPNet, []string) {
+	var subnets []*net.IPNet
+	var refused []string
+
+	for _, cidr := range config.Get("subnets", "static", name).StringSlice(nil) {
+		if _, subnet, err := net.ParseCIDR(cidr); nil != err {
+			log.Printf("server: subnets: bad static subnet %s for %s: %s", cidr, name, err)
+		} else {
+			subnets = append(subnets, subnet)
+		}
+	}
+
+	var allowed []*net.IPNet
+	for _, cidr := range config.Get("subnets", "allowed", name).StringSlice(nil) {
+		if _, subnet, err := net.ParseCIDR(cidr); nil != err {
+			log.Printf("server: subnets: bad allowed subnet %s for %s: %s", cidr, name, err)
+		} else {
+			allowed = append(allowed, subnet)
+		}
+	}
+
+	for _, cidr := range advertised {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if nil != err || !subnetwithin(subnet, allowed) {
+			refused = append(refused, cidr)
+			continue
+		}
+		subnets = append(subnets, subnet)
+	}
+
+	return subnets, refused
+}
+
+// Check if subnet falls entirely inside one of the networks
+func subnetwithin(subnet *net.IPNet, networks []*net.IPNet) bool {
+	bits, _ := subnet.Mask.Size()
+	for _, network := range networks {
+		netbits, _ := network.Mask.Size()
+		if netbits <= bits && network.Contains(subnet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// The clients serving each subnet, in the order they connected
+// The latest to connect serves a subnet, falling back to the one before it when it disconnects
+type subnetowners map[string][]*Client
+
+// Add client as the latest to serve subnet, returning true if nobody served it before
+func (o subnetowners) add(subnet *net.IPNet, client *Client) bool {
+	key := subnet.String()
+	o[key] = append(o[key], client)
+	return len(o[key]) == 1
+}
+
+// The client serving subnet, nil when nobody does
+func (o subnetowners) serving(subnet *net.IPNet) *Client {
+	clients := o[subnet.String()]
+	if len(clients) == 0 {
+		return nil
+	}
+	return clients[len(clients)-1]
+}
+
+// Remove client from the clients serving subnet, returning false if it wasn't one of them
+func (o subnetowners) drop(subnet *net.IPNet, client *Client) bool {
+	key := subnet.String()
+	clients := o[key]
+	for i := len(clients) - 1; i >= 0; i-- {
+		if clients[i] == client {
+			if len(clients) == 1 {
+				delete(o, key)
+			} else {
+				o[key] = append(clients[:i:i], clients[i+1:]...)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Installs kernel routes on the tun adapter for the extra address pools, and the subnets served by connected clients
+// Exits when the state channel is closed
+func kernroutes(subchan chan<- ClientStateSub, tunname string, pools []*net.IPNet) {
+	// Channel to receive client state
+	statechan := make(chan ClientState)
+
+	// Subscribe to client state stream
+	subchan <- ClientStateSub{name: "kernroutes", subchan: statechan}
+
+	tunlink, err := netlink.LinkByName(tunname)
+	if nil != err {
+		log.Fatalf("server: kernroutes: unable to find tun link %s: %s", tunname, err)
+	}
+
+	// The address pools besides the server's netblock are always routed to the tun
+	for _, ipnet := range pools {
+		if err := netlink.RouteReplace(&netlink.Route{LinkIndex: tunlink.Attrs().Index, Dst: ipnet}); nil != err {
+			log.Fatalf("server: kernroutes: failed adding route %s for address pool: %s", ipnet, err)
+		}
+		log.Printf("server: kernroutes: added route %s for address pool", ipnet)
+	}
+
+	// The clients serving each subnet, the route is kept until the last of them disconnects
+	owners := make(subnetowners)
+
+	log.Print("server: kernroutes: starting")
+	for state := range statechan {
+		for _, subnet := range state.client.subnets {
+			route := &netlink.Route{LinkIndex: tunlink.Attrs().Index, Dst: subnet}
+
+			if state.transition == Connect {
+				if err := netlink.RouteReplace(route); nil != err {
+					log.Printf("server: kernroutes: failed adding route %s for %s-%#x: %s", subnet, state.client.name, state.client.id, err)
+					continue
+				}
+
+				log.Printf("server: kernroutes: added route %s for %s-%#x", subnet, state.client.name, state.client.id)
+				if owners.add(subnet, state.client) {
+					route_subnetsmetric.Inc()
+				}
+			} else if state.transition == Disconnect {
+				// The route was never added for this session
+				if !owners.drop(subnet, state.client) {
+					continue
+				}
+
+				// Another session still serves the subnet, leave the route be
+				if next := owners.serving(subnet); next != nil {
+					log.Printf("server: kernroutes: keeping route %s, %s-%#x still serves it", subnet, next.name, next.id)
+					continue
+				}
+
+				route_subnetsmetric.Dec()
+				if err := netlink.RouteDel(route); nil != err {
+					log.Printf("server: kernroutes: failed removing route %s for %s-%#x: %s", subnet, state.client.name, state.client.id, err)
+				} else {
+					log.Printf("server: kernroutes: removed route %s for %s-%#x", subnet, state.client.name, state.client.id)
+				}
+			}
+		}
+	}
+	log.Print("server: kernroutes(term): statechan closed")
+}
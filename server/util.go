@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"net"
 )
 
@@ -15,6 +16,15 @@ func randUint64() (uint64, error) {
 	return binary.LittleEndian.Uint64(b[:]), nil
 }
 
+// Generate a random 128bit hex encoded token
+func randToken() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
 func ip2int(ip net.IP) uint32 {
 	if len(ip) == 16 {
 		return binary.BigEndian.Uint32(ip[12:16])
@@ -27,3 +37,58 @@ func int2ip(nn uint32) net.IP {
 	binary.BigEndian.PutUint32(ip, nn)
 	return ip
 }
+
+// The address offset from the start of an IPv6 prefix
+// Prefixes are at most /96, so the offset never carries into the prefix
+func addr6(prefix net.IP, offset uint32) net.IP {
+	ip := make(net.IP, 16)
+	copy(ip, prefix.To16())
+	binary.BigEndian.PutUint32(ip[12:], binary.BigEndian.Uint32(ip[12:])+offset)
+	return ip
+}
+
+// The source address of an IPv4 or IPv6 packet, nil if it is neither or too short
+func srcaddr(packet []byte) []byte {
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		return packet[12:16]
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		return packet[8:24]
+	}
+	return nil
+}
+
+// The destination address of an IPv4 or IPv6 packet, nil if it is neither or too short
+func dstaddr(packet []byte) []byte {
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		return packet[16:20]
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		return packet[24:40]
+	}
+	return nil
+}
+
+// The address of ip as a route table key, 4 bytes for IPv4 and 16 for IPv6
+func routekey(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+// Format an optional IPv6 address, empty when it is nil
+func ip6string(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// Read the 16-bit word at off, padding with zero past the end of buf
+func word(buf []byte, off int) uint16 {
+	if off+1 < len(buf) {
+		return binary.BigEndian.Uint16(buf[off:])
+	}
+	return uint16(buf[off]) << 8
+}